@@ -1,11 +1,21 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"errors"
 	"flag"
 	"io"
 	"log"
 	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/pprof"
+	"strings"
 
 	"github.com/Qv2ray/gun-lite/pkg/realgun"
 )
@@ -14,11 +24,56 @@ var (
 	RemoteAddr  = flag.String("remote", "", "remote gun server address")
 	LocalAddr   = flag.String("local", "", "local server endpoint")
 	ServerName  = flag.String("sni", "", "(optional) server name indication")
+	HostHeader  = flag.String("host", "", "(optional) HTTP/2 :authority, e.g. for domain fronting")
 	ServiceName = flag.String("service", "", "(optional) custom service name")
+	Path        = flag.String("path", "", "(optional) custom request path replacing /{service}/Tun")
 	Cleartext   = flag.Bool("cleartext", false, "(optional) use unsafe h2c")
+	Multi       = flag.Bool("multi", false, "(optional) call TunMulti like the multiMode of v2ray and Xray")
+	RandomPath  = flag.String("randompath", "", "(optional) vary request path per stream: segment or query")
+	Profiles    = flag.String("profiles", "", "(optional) comma separated header profiles: grpc-go, grpc-java, grpc-swift")
+	Lenient     = flag.Bool("lenient", false, "(optional) tolerate mismatched message lengths from peers")
+	Resync      = flag.Bool("resync", false, "(optional) skip over corrupted messages instead of failing")
+	Adaptive    = flag.Bool("adaptive", false, "(optional) adapt message size to the traffic")
+	RootCA      = flag.String("ca", "", "(optional) PEM file of the CA certificates to trust")
+	Insecure    = flag.Bool("insecure", false, "(optional) skip verifying the server certificate")
+	PinPubKey   = flag.String("pinpubkey", "", "(optional) comma separated base64 SHA-256 hashes of the only server public keys to trust")
+	PinPeer     = flag.String("pinpeer", "", "(optional) comma separated base64 SHA-256 hashes of certificates or public keys, one of which the server chain must contain")
+	ClientCert  = flag.String("cert", "", "(optional) PEM file of the client certificate for mutual TLS")
+	ClientKey   = flag.String("key", "", "(optional) PEM file of the client certificate key")
+	Socks5      = flag.String("socks5", "", "(optional) upstream SOCKS5 proxy as [user:password@]host:port")
+	HTTPProxy   = flag.String("httpproxy", "", "(optional) upstream HTTP proxy as [user:password@]host:port")
+	DialTimeout = flag.Duration("dialtimeout", 0, "(optional) timeout of connecting to the remote")
+	RespTimeout = flag.Duration("resptimeout", 0, "(optional) timeout of waiting for the remote to answer a stream")
+	IdlePing    = flag.Duration("idleping", 0, "(optional) ping connections idle for this long to detect dead ones")
+	IdlePingAll = flag.Bool("idlepingall", false, "(optional) with -idleping, also ping connections carrying no stream")
+	Compress    = flag.String("compress", "", "(optional) compress tunneled data with lz4 or deflate, gun-lite servers only")
+	Endpoints   = flag.String("endpoints", "", "(optional) comma separated fallback addresses of the remote gun server")
+	RaceDial    = flag.Bool("race", false, "(optional) dial the remote and all fallback addresses at once, using the fastest")
+	DNS         = flag.String("dns", "", "(optional) DNS server as host:port to resolve the remote with")
+	DoH         = flag.String("doh", "", "(optional) DNS-over-HTTPS URL to resolve the remote with, e.g. https://1.1.1.1/dns-query")
+	ALPN        = flag.String("alpn", "", "(optional) comma separated ALPN protocols to offer, e.g. h2,http/1.1")
+	RemoteIPs   = flag.String("remoteips", "", "(optional) comma separated IPs to connect to instead of resolving the remote host")
+	SessionFile = flag.String("sessionfile", "", "(optional) file to keep TLS sessions in, so restarts resume them")
 )
 
+// Headers collects the repeated -header flags.
+var Headers = make(http.Header)
+
+type headerFlag struct{}
+
+func (headerFlag) String() string { return "" }
+
+func (headerFlag) Set(s string) error {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return errors.New("want Name: value")
+	}
+	Headers.Add(strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:]))
+	return nil
+}
+
 func init() {
+	flag.Var(headerFlag{}, "header", "(optional) extra request header as \"Name: value\", repeatable")
 	flag.Parse()
 }
 
@@ -29,16 +84,149 @@ func main() {
 	if *LocalAddr == "" {
 		log.Fatal("need local endpoint")
 	}
+	var randomPath realgun.RandomPath
+	switch *RandomPath {
+	case "":
+	case "segment":
+		randomPath = realgun.RandomPathSegment
+	case "query":
+		randomPath = realgun.RandomPathQuery
+	default:
+		log.Fatalf("unknown random path mode %q", *RandomPath)
+	}
+	var compression realgun.Compression
+	switch *Compress {
+	case "":
+	case "lz4":
+		compression = realgun.CompressionLZ4
+	case "deflate":
+		compression = realgun.CompressionDeflate
+	default:
+		log.Fatalf("unknown compression %q", *Compress)
+	}
+	mode := realgun.ModeTun
+	if *Multi {
+		mode = realgun.ModeMulti
+	}
+	var profiles []*realgun.HeaderProfile
+	if *Profiles != "" {
+		for _, name := range strings.Split(*Profiles, ",") {
+			p := realgun.LookupHeaderProfile(strings.TrimSpace(name))
+			if p == nil {
+				log.Fatalf("unknown header profile %q", name)
+			}
+			profiles = append(profiles, p)
+		}
+	}
+	var rootCAs *x509.CertPool
+	if *RootCA != "" {
+		pem, err := os.ReadFile(*RootCA)
+		if err != nil {
+			log.Fatalf("failed to read CA file: %v", err)
+		}
+		rootCAs = x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(pem) {
+			log.Fatalf("no certificates in CA file %v", *RootCA)
+		}
+	}
+	pins := parsePins(*PinPubKey)
+	peerPins := parsePins(*PinPeer)
+	var clientCert, clientKey []byte
+	if *ClientCert != "" {
+		var err error
+		if clientCert, err = os.ReadFile(*ClientCert); err != nil {
+			log.Fatalf("failed to read client certificate: %v", err)
+		}
+		if clientKey, err = os.ReadFile(*ClientKey); err != nil {
+			log.Fatalf("failed to read client key: %v", err)
+		}
+	}
+	var socks5 *realgun.Socks5Proxy
+	if *Socks5 != "" {
+		addr, username, password := parseProxy(*Socks5)
+		socks5 = &realgun.Socks5Proxy{Addr: addr, Username: username, Password: password}
+	}
+	var httpProxy *realgun.HTTPProxy
+	if *HTTPProxy != "" {
+		addr, username, password := parseProxy(*HTTPProxy)
+		httpProxy = &realgun.HTTPProxy{Addr: addr, Username: username, Password: password}
+	}
+	var remoteIPs []string
+	if *RemoteIPs != "" {
+		for _, ip := range strings.Split(*RemoteIPs, ",") {
+			remoteIPs = append(remoteIPs, strings.TrimSpace(ip))
+		}
+	}
+	var endpoints []string
+	if *Endpoints != "" {
+		for _, endpoint := range strings.Split(*Endpoints, ",") {
+			endpoints = append(endpoints, strings.TrimSpace(endpoint))
+		}
+	}
+	var resolver *net.Resolver
+	if *DNS != "" {
+		resolver = &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, *DNS)
+		}}
+	}
+	if *DoH != "" {
+		if *DNS != "" {
+			log.Fatal("need at most one of -dns and -doh")
+		}
+		resolver = realgun.NewDoHResolver(*DoH, nil)
+	}
+	var alpn []string
+	if *ALPN != "" {
+		for _, proto := range strings.Split(*ALPN, ",") {
+			alpn = append(alpn, strings.TrimSpace(proto))
+		}
+	}
+	var sessionCache tls.ClientSessionCache
+	if *SessionFile != "" {
+		var err error
+		if sessionCache, err = realgun.NewFileSessionCache(*SessionFile, 0); err != nil {
+			log.Fatalf("failed to load TLS sessions: %v", err)
+		}
+	}
 	listen, err := net.Listen("tcp", *LocalAddr)
 	if err != nil {
 		log.Fatalf("failed to listen tcp %v: %v", *LocalAddr, err)
 	}
 
 	client := realgun.NewGunClient(&realgun.Config{
-		RemoteAddr:  *RemoteAddr,
-		ServerName:  *ServerName,
-		ServiceName: *ServiceName,
-		Cleartext:   *Cleartext,
+		RemoteAddr:            *RemoteAddr,
+		ServerName:            *ServerName,
+		ServiceName:           *ServiceName,
+		Cleartext:             *Cleartext,
+		Mode:                  mode,
+		RandomPath:            randomPath,
+		HeaderProfiles:        profiles,
+		LenientRead:           *Lenient,
+		Resync:                *Resync,
+		AdaptiveHunkSize:      *Adaptive,
+		RootCAs:               rootCAs,
+		AllowInsecure:         *Insecure,
+		PinnedPublicKeys:      pins,
+		PinnedPeerSHA256:      peerPins,
+		ClientCertificate:     clientCert,
+		ClientKey:             clientKey,
+		Compression:           compression,
+		Socks5Proxy:           socks5,
+		HTTPProxy:             httpProxy,
+		Headers:               Headers,
+		HostHeader:            *HostHeader,
+		Path:                  *Path,
+		ReadIdleTimeout:       *IdlePing,
+		PermitWithoutStream:   *IdlePingAll,
+		DialTimeout:           *DialTimeout,
+		ResponseHeaderTimeout: *RespTimeout,
+		RemoteIPs:             remoteIPs,
+		Endpoints:             endpoints,
+		RaceEndpoints:         *RaceDial,
+		Resolver:              resolver,
+		NextProtos:            alpn,
+		SessionCache:          sessionCache,
 	})
 
 	for {
@@ -52,23 +240,57 @@ func main() {
 			remoteConn, err := client.DialConn()
 			if err != nil {
 				log.Printf("dial remote failed: %v", err)
+				return
+			}
+			if g, ok := remoteConn.(*realgun.GunConn); ok {
+				pprof.SetGoroutineLabels(pprof.WithLabels(context.Background(), g.Labels()))
 			}
+			log.Printf("%v: tunneling %v", remoteConn, localConn.RemoteAddr())
 
 			go func() {
 				defer remoteConn.Close()
 				n, e := io.Copy(localConn, remoteConn)
 				if e != nil && !errors.Is(e, net.ErrClosed) {
-					log.Printf("copy from remote to local failed: %v", e)
+					log.Printf("%v: copy from remote to local failed: %v", remoteConn, e)
 				}
-				log.Printf("copied %d bytes from remote to local", n)
+				log.Printf("%v: copied %d bytes from remote to local", remoteConn, n)
 			}()
 
 			n, e := io.Copy(remoteConn, localConn)
 			if e != nil && !errors.Is(e, net.ErrClosed) {
-				log.Printf("copy from local to remote failed: %v", e)
+				log.Printf("%v: copy from local to remote failed: %v", remoteConn, e)
 			}
-			log.Printf("copied %d bytes from local to remote", n)
+			log.Printf("%v: copied %d bytes from local to remote", remoteConn, n)
 		}()
 
 	}
 }
+
+// parsePins decodes a comma separated list of base64 SHA-256 hashes.
+func parsePins(s string) [][]byte {
+	if s == "" {
+		return nil
+	}
+	var pins [][]byte
+	for _, s := range strings.Split(s, ",") {
+		pin, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+		if err != nil || len(pin) != sha256.Size {
+			log.Fatalf("invalid hash %q", s)
+		}
+		pins = append(pins, pin)
+	}
+	return pins
+}
+
+// parseProxy splits a proxy flag of the form [user:password@]host:port.
+func parseProxy(s string) (addr, username, password string) {
+	u, err := url.Parse("proxy://" + s)
+	if err != nil {
+		log.Fatalf("invalid proxy %q: %v", s, err)
+	}
+	if u.User != nil {
+		username = u.User.Username()
+		password, _ = u.User.Password()
+	}
+	return u.Host, username, password
+}
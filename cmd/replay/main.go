@@ -0,0 +1,76 @@
+// Command replay reproduces gun sessions from captures: it sends a captured
+// request body to a server and writes the raw response, or decodes a
+// captured response body into its messages.
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/Qv2ray/gun-lite/pkg/realgun"
+)
+
+var (
+	RemoteAddr  = flag.String("remote", "", "remote gun server address, to replay a request capture")
+	ServerName  = flag.String("sni", "", "(optional) server name indication")
+	ServiceName = flag.String("service", "", "(optional) custom service name")
+	Cleartext   = flag.Bool("cleartext", false, "(optional) use unsafe h2c")
+	Insecure    = flag.Bool("insecure", false, "(optional) skip verifying the server certificate")
+	Lenient     = flag.Bool("lenient", false, "(optional) tolerate mismatched message lengths")
+	Resync      = flag.Bool("resync", false, "(optional) skip over corrupted messages instead of failing")
+	Capture     = flag.String("capture", "", "capture file")
+	Output      = flag.String("out", "", "(optional) file for the raw response, instead of decoding it")
+)
+
+func main() {
+	flag.Parse()
+	if *Capture == "" {
+		log.Fatal("need capture file")
+	}
+	client := realgun.NewGunClient(&realgun.Config{
+		RemoteAddr:    *RemoteAddr,
+		ServerName:    *ServerName,
+		ServiceName:   *ServiceName,
+		Cleartext:     *Cleartext,
+		AllowInsecure: *Insecure,
+		LenientRead:   *Lenient,
+		Resync:        *Resync,
+	})
+
+	capture, err := os.Open(*Capture)
+	if err != nil {
+		log.Fatalf("failed to open capture: %v", err)
+	}
+	defer capture.Close()
+
+	if *RemoteAddr == "" {
+		decode(client, capture)
+		return
+	}
+	response, err := client.ReplayCapture(capture)
+	if err != nil {
+		log.Printf("replay failed after %d response bytes: %v", len(response), err)
+	}
+	if *Output != "" {
+		if err := os.WriteFile(*Output, response, 0644); err != nil {
+			log.Fatalf("failed to write response: %v", err)
+		}
+		return
+	}
+	decode(client, bytes.NewReader(response))
+}
+
+func decode(client *realgun.Client, capture io.Reader) {
+	messages, err := client.DecodeCapture(capture)
+	for i, m := range messages {
+		fmt.Printf("message %d: %d bytes\n%s", i, len(m), hex.Dump(m))
+	}
+	if err != nil {
+		log.Fatalf("decoding failed after %d messages: %v", len(messages), err)
+	}
+}
@@ -0,0 +1,132 @@
+// Package gun defines the stable interfaces of gun-lite. Depend on these
+// rather than on the realgun package, whose types may change as the
+// implementation evolves.
+package gun
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Qv2ray/gun-lite/pkg/realgun"
+)
+
+// Conn is a single gun stream.
+type Conn interface {
+	net.Conn
+	// ID returns the process-wide unique ID of the stream.
+	ID() uint64
+	// Context returns a context cancelled when the stream dies.
+	Context() context.Context
+	// Trailer returns the trailer metadata of the peer, once the stream ended.
+	Trailer() http.Header
+}
+
+// Dialer opens gun streams. Conns it returns implement Conn unless the
+// dialer has been configured with middlewares that wrap them.
+type Dialer interface {
+	DialConn() (net.Conn, error)
+}
+
+// ContextDialer opens gun streams bound to a context.
+type ContextDialer interface {
+	Dialer
+	DialConnContext(ctx context.Context) (net.Conn, error)
+}
+
+// Listener accepts gun streams.
+type Listener interface {
+	net.Listener
+}
+
+// DialerConfig configures a Dialer. It holds the options the package keeps
+// stable, and is translated to the configuration of the implementation.
+type DialerConfig struct {
+	// RemoteAddr is the host:port of the server.
+	RemoteAddr string
+	// ServerName, if set, is sent in SNI instead of the host of RemoteAddr.
+	ServerName string
+	// ServiceName names the gRPC service, GunService by default. Path, if
+	// set, replaces the whole request path.
+	ServiceName string
+	Path        string
+	// HostHeader, if set, is sent as :authority instead of RemoteAddr.
+	HostHeader string
+	// Headers are sent with every stream.
+	Headers http.Header
+	// Cleartext speaks h2c instead of HTTP/2 over TLS. TLSConfig, if set,
+	// configures TLS otherwise.
+	Cleartext bool
+	TLSConfig *tls.Config
+	// DialContext, if set, dials the connections to the server.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+	// DialTimeout bounds dialing a connection including the handshakes,
+	// and ResponseHeaderTimeout waiting for the server to accept a stream.
+	DialTimeout           time.Duration
+	ResponseHeaderTimeout time.Duration
+	// ReadIdleTimeout, if set, pings connections silent for that long and
+	// closes them if no answer comes within PingTimeout.
+	ReadIdleTimeout time.Duration
+	PingTimeout     time.Duration
+}
+
+func (c *DialerConfig) realgun() *realgun.Config {
+	return &realgun.Config{
+		RemoteAddr:            c.RemoteAddr,
+		ServerName:            c.ServerName,
+		ServiceName:           c.ServiceName,
+		Path:                  c.Path,
+		HostHeader:            c.HostHeader,
+		Headers:               c.Headers,
+		Cleartext:             c.Cleartext,
+		TLSConfig:             c.TLSConfig,
+		DialContext:           c.DialContext,
+		DialTimeout:           c.DialTimeout,
+		ResponseHeaderTimeout: c.ResponseHeaderTimeout,
+		ReadIdleTimeout:       c.ReadIdleTimeout,
+		PingTimeout:           c.PingTimeout,
+	}
+}
+
+// ListenerConfig configures a Listener. It holds the options the package
+// keeps stable, and is translated to the configuration of the
+// implementation.
+type ListenerConfig struct {
+	// ServiceName names the gRPC service, GunService by default. Path, if
+	// set, replaces the whole request path.
+	ServiceName string
+	Path        string
+	// TLSConfig, if set, makes the listener terminate TLS. Otherwise it
+	// speaks cleartext h2c.
+	TLSConfig *tls.Config
+	// IdleTimeout, if set, closes connections without streams for that long.
+	IdleTimeout time.Duration
+}
+
+func (c *ListenerConfig) realgun() *realgun.ServerConfig {
+	return &realgun.ServerConfig{
+		ServiceName: c.ServiceName,
+		Path:        c.Path,
+		TLSConfig:   c.TLSConfig,
+		IdleTimeout: c.IdleTimeout,
+	}
+}
+
+// NewDialer returns a Dialer for config.
+func NewDialer(config *DialerConfig) Dialer {
+	return realgun.NewGunClient(config.realgun())
+}
+
+// NewListener returns a Listener accepting gun streams on listener.
+func NewListener(listener net.Listener, config *ListenerConfig) Listener {
+	return realgun.NewGunServer(listener, config.realgun())
+}
+
+var (
+	_ Conn          = (*realgun.GunConn)(nil)
+	_ Dialer        = (*realgun.Client)(nil)
+	_ ContextDialer = (*realgun.Client)(nil)
+	_ Listener      = (*realgun.Server)(nil)
+)
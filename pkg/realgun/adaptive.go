@@ -0,0 +1,51 @@
+package realgun
+
+import "time"
+
+const (
+	adaptiveMinHunkSize   = 2 << 10
+	adaptiveStartHunkSize = 16 << 10
+	adaptiveMaxHunkSize   = 128 << 10
+	// adaptiveIdleGap is the pause between writes after which a stream is
+	// treated as interactive again.
+	adaptiveIdleGap = 200 * time.Millisecond
+	// adaptiveSlowWrite is how long a hunk may block on flow control before
+	// the link is considered congested.
+	adaptiveSlowWrite = 50 * time.Millisecond
+)
+
+// hunkSizer picks the hunk size for a stream from its recent writes. Hunks
+// grow while the caller keeps filling them and the link keeps up, and shrink
+// when writes block on the peer, bounding the latency a single hunk adds.
+type hunkSizer struct {
+	size      int
+	lastWrite time.Time
+}
+
+func newHunkSizer() *hunkSizer {
+	return &hunkSizer{size: adaptiveStartHunkSize}
+}
+
+// begin is called at the start of every Write.
+func (s *hunkSizer) begin(now time.Time) {
+	if !s.lastWrite.IsZero() && now.Sub(s.lastWrite) > adaptiveIdleGap {
+		s.size = adaptiveMinHunkSize
+	}
+}
+
+// observe records that a hunk of n bytes was written from start to end.
+func (s *hunkSizer) observe(n int, start, end time.Time) {
+	s.lastWrite = end
+	switch {
+	case end.Sub(start) > adaptiveSlowWrite:
+		s.size /= 2
+	case n == s.size:
+		s.size *= 2
+	}
+	if s.size < adaptiveMinHunkSize {
+		s.size = adaptiveMinHunkSize
+	}
+	if s.size > adaptiveMaxHunkSize {
+		s.size = adaptiveMaxHunkSize
+	}
+}
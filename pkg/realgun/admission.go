@@ -0,0 +1,22 @@
+package realgun
+
+import (
+	"context"
+	"net"
+)
+
+// AdmissionInfo describes a new stream to an AdmitFunc.
+type AdmissionInfo struct {
+	RemoteAddr net.Addr
+	Path       string
+	// User is the user the stream is authenticated as, see GunConn.User.
+	User string
+	// ActiveStreams is the number of streams the server serves.
+	ActiveStreams int
+}
+
+// AdmitFunc decides on a new stream before anything is allocated for it.
+// It may block to defer the stream until ctx, the context of its request,
+// is done. A non-nil error refuses the stream with gRPC status
+// RESOURCE_EXHAUSTED and the error as message.
+type AdmitFunc func(ctx context.Context, info AdmissionInfo) error
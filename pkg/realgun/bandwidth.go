@@ -0,0 +1,87 @@
+package realgun
+
+import (
+	"sync"
+	"time"
+)
+
+// bandwidthBurst is how far a byteLimiter lets bytes get ahead of its rate
+// after an idle period.
+const bandwidthBurst = 250 * time.Millisecond
+
+// byteLimiter paces bytes to a rate, shared by all streams of a user.
+type byteLimiter struct {
+	rate float64
+
+	mu sync.Mutex
+	// next is when the bytes passed so far are paid for
+	next time.Time
+}
+
+func newByteLimiter(rate float64) *byteLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &byteLimiter{rate: rate}
+}
+
+// wait blocks until n more bytes fit the rate, or done is closed.
+func (l *byteLimiter) wait(n int, done <-chan struct{}) {
+	now := time.Now()
+	l.mu.Lock()
+	if earliest := now.Add(-bandwidthBurst); l.next.Before(earliest) {
+		l.next = earliest
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+	if delay <= 0 {
+		return
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-done:
+	}
+}
+
+// throttle paces n bytes the stream read or wrote by l, if set.
+func (g *GunConn) throttle(l *byteLimiter, n int) {
+	if l != nil && n > 0 {
+		l.wait(n, g.done)
+	}
+}
+
+// userBandwidth holds the limiters of a user while they have streams.
+type userBandwidth struct {
+	upload, download *byteLimiter
+	streams          int
+}
+
+// acquireBandwidth returns the limiters of the streams of user, see
+// ServerConfig.UserUploadRate, until released as often as acquired.
+func (h *Handler) acquireBandwidth(user string) *userBandwidth {
+	h.bandwidthMu.Lock()
+	defer h.bandwidthMu.Unlock()
+	bw := h.bandwidth[user]
+	if bw == nil {
+		bw = &userBandwidth{
+			upload:   newByteLimiter(h.config.UserUploadRate),
+			download: newByteLimiter(h.config.UserDownloadRate),
+		}
+		h.bandwidth[user] = bw
+	}
+	bw.streams++
+	return bw
+}
+
+func (h *Handler) releaseBandwidth(user string) {
+	h.bandwidthMu.Lock()
+	defer h.bandwidthMu.Unlock()
+	if bw := h.bandwidth[user]; bw != nil {
+		if bw.streams--; bw.streams == 0 {
+			delete(h.bandwidth, user)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package realgun
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// memoryBudget caps the bytes buffered by all streams of the process.
+type memoryBudget struct {
+	mu    sync.Mutex
+	limit int64
+	used  int64
+	// freed is closed and replaced whenever bytes are released
+	freed chan struct{}
+}
+
+var globalBudget = &memoryBudget{freed: make(chan struct{})}
+
+// SetMemoryBudget caps the total number of received bytes buffered across
+// all streams. Once the cap is reached, streams stop reading from the network
+// until buffered data is consumed, so HTTP/2 flow control pushes back on the
+// senders. A limit <= 0 removes the cap, which is the default.
+//
+// The cap does not cover data buffered inside the HTTP/2 transport, which is
+// bounded by its flow-control windows.
+func SetMemoryBudget(limit int64) {
+	globalBudget.mu.Lock()
+	globalBudget.limit = limit
+	globalBudget.mu.Unlock()
+	globalBudget.release(0)
+}
+
+// BufferedBytes returns the number of received bytes currently buffered across all streams.
+func BufferedBytes() int64 {
+	globalBudget.mu.Lock()
+	defer globalBudget.mu.Unlock()
+	return globalBudget.used
+}
+
+// acquire blocks until n bytes fit in the budget or done is closed. A single
+// hunk is always admitted when nothing else is buffered, so oversized hunks
+// cannot stall forever.
+func (b *memoryBudget) acquire(n int64, done <-chan struct{}) error {
+	for {
+		b.mu.Lock()
+		if b.limit <= 0 || b.used == 0 || b.used+n <= b.limit {
+			b.used += n
+			b.mu.Unlock()
+			return nil
+		}
+		freed := b.freed
+		b.mu.Unlock()
+		select {
+		case <-freed:
+		case <-done:
+			return ErrClosed
+		}
+	}
+}
+
+func (b *memoryBudget) release(n int64) {
+	b.mu.Lock()
+	b.used -= n
+	close(b.freed)
+	b.freed = make(chan struct{})
+	b.mu.Unlock()
+}
+
+// releaseHeld returns the bytes held by g to the budget.
+func (g *GunConn) releaseHeld() {
+	if n := atomic.SwapInt64(&g.held, 0); n > 0 {
+		globalBudget.release(n)
+	}
+}
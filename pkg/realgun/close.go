@@ -0,0 +1,92 @@
+package realgun
+
+import (
+	"sync"
+	"time"
+)
+
+// Close shuts cli down: it closes the active streams, aborting those still
+// being dialed, and the pooled connections, and stops keeping connections
+// warm. With DrainTimeout, the streams are drained concurrently until a
+// single deadline. Later dials fail with ErrClosed, and connections still
+// being dialed are closed once they are up. A Client returned by SharedClient
+// is dropped from the registry, so the next call creates a new one.
+func (cli *Client) Close() error {
+	cli.closeOnce.Do(func() {
+		close(cli.done)
+	})
+	unregister(cli)
+	cli.streamsMu.Lock()
+	conns := make([]*GunConn, 0, len(cli.streams))
+	for _, g := range cli.streams {
+		conns = append(conns, g)
+	}
+	cli.streamsMu.Unlock()
+	// drain all streams at once, so Close takes one DrainTimeout at most
+	deadline := time.Now().Add(cli.drainTimeout)
+	var wg sync.WaitGroup
+	for _, g := range conns {
+		wg.Add(1)
+		go func(g *GunConn) {
+			defer wg.Done()
+			_ = g.closeDraining(deadline)
+		}(g)
+	}
+	wg.Wait()
+	cli.pool.close()
+	return nil
+}
+
+// CloseIdleConnections closes the pooled connections carrying no stream.
+func (cli *Client) CloseIdleConnections() {
+	cli.pool.closeConns(true)
+}
+
+func (cli *Client) isClosed() bool {
+	select {
+	case <-cli.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// close closes the pooled connections and keeps the pool from taking new
+// ones.
+func (p *connPool) close() {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.done)
+	}
+	p.mu.Unlock()
+	p.closeConns(false)
+}
+
+// closeConns closes the pooled connections, or only those without streams
+// if idleOnly.
+func (p *connPool) closeConns(idleOnly bool) {
+	var closing []*pooledConn
+	p.mu.Lock()
+	for addr, conns := range p.conns {
+		kept := conns[:0:0]
+		for _, pc := range conns {
+			if idleOnly && pc.streams > 0 {
+				kept = append(kept, pc)
+				continue
+			}
+			closing = append(closing, pc)
+			p.unpin(pc)
+		}
+		if len(kept) == 0 {
+			delete(p.conns, addr)
+		} else {
+			p.conns[addr] = kept
+		}
+	}
+	p.mu.Unlock()
+	for _, pc := range closing {
+		_ = pc.cc.Close()
+		_ = pc.conn.Close()
+	}
+}
@@ -0,0 +1,182 @@
+package realgun
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"net/http"
+)
+
+// Compression selects how the data of streams is compressed.
+type Compression int
+
+const (
+	// CompressionNone sends the data as is.
+	CompressionNone Compression = iota
+	// CompressionLZ4 compresses every write as LZ4 blocks, cheap enough for
+	// fast links at a modest ratio.
+	CompressionLZ4
+	// CompressionDeflate compresses the stream as one deflate session,
+	// flushed at every write, for the better ratio on slow links.
+	CompressionDeflate
+)
+
+const (
+	// compressionHeader announces the compression of the client, and that
+	// it expects the server to compress its data the same way.
+	compressionHeader  = "gun-encoding"
+	compressionLZ4     = "lz4"
+	compressionDeflate = "deflate"
+)
+
+// compressedConn compresses the data of a stream, each write going out at
+// once.
+type compressedConn struct {
+	*GunConn
+
+	// wsem is the write lock, a channel so Close can skip finishing the
+	// stream while a write is blocked
+	wsem chan struct{}
+	// buf and zw are the deflate session, frames the buffer of LZ4
+	buf    bytes.Buffer
+	zw     *flate.Writer
+	frames []byte
+	zr     io.Reader
+	// finished is set once the compressed stream ended
+	finished bool
+}
+
+func newCompressedConn(g *GunConn, compression Compression) *compressedConn {
+	c := &compressedConn{GunConn: g, wsem: make(chan struct{}, 1)}
+	if compression == CompressionLZ4 {
+		c.zr = newLZ4Reader(g)
+	} else {
+		c.zr = flate.NewReader(g)
+		c.zw, _ = flate.NewWriter(&c.buf, flate.DefaultCompression)
+	}
+	return c
+}
+
+func (c *compressedConn) Read(b []byte) (int, error) {
+	return c.zr.Read(b)
+}
+
+// compress returns b compressed. The write lock must be held.
+func (c *compressedConn) compress(b []byte) []byte {
+	if c.zw == nil {
+		c.frames = appendLZ4Frames(c.frames[:0], b)
+		return c.frames
+	}
+	c.buf.Reset()
+	_, _ = c.zw.Write(b)
+	_ = c.zw.Flush()
+	return c.buf.Bytes()
+}
+
+func (c *compressedConn) Write(b []byte) (int, error) {
+	c.wsem <- struct{}{}
+	defer func() { <-c.wsem }()
+	if c.finished {
+		return 0, ErrClosed
+	}
+	if _, err := c.GunConn.Write(c.compress(b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// TryWrite compresses b only once the stream can take it, as the deflate
+// session cannot take back data of a write that would block.
+func (c *compressedConn) TryWrite(b []byte) (int, error) {
+	c.wsem <- struct{}{}
+	defer func() { <-c.wsem }()
+	if c.finished {
+		return 0, ErrClosed
+	}
+	select {
+	case <-c.GunConn.Writable():
+	default:
+		return 0, ErrWouldBlock
+	}
+	if _, err := c.GunConn.TryWrite(c.compress(b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ReadFrom and WriteTo shadow the ones of GunConn, which would bypass the
+// compression.
+func (c *compressedConn) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(struct{ io.Writer }{c}, r)
+}
+
+func (c *compressedConn) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, struct{ io.Reader }{c})
+}
+
+// CloseWrite ends the compressed stream before ending the sending side.
+func (c *compressedConn) CloseWrite() error {
+	c.wsem <- struct{}{}
+	err := c.finish()
+	<-c.wsem
+	if err != nil {
+		return err
+	}
+	return c.GunConn.CloseWrite()
+}
+
+// Close ends the compressed stream, so the peer reads all data written,
+// unless a write is still blocked, which Close aborts.
+func (c *compressedConn) Close() error {
+	select {
+	case c.wsem <- struct{}{}:
+		if !c.GunConn.isClosed() {
+			_ = c.finish()
+		}
+		<-c.wsem
+	default:
+	}
+	return c.GunConn.Close()
+}
+
+// finish ends the compressed stream, so the peer reads EOF instead of a
+// truncated deflate session. Later writes fail with ErrClosed. The write
+// lock must be held.
+func (c *compressedConn) finish() error {
+	if c.finished {
+		return nil
+	}
+	c.finished = true
+	if c.zw == nil {
+		return nil
+	}
+	c.buf.Reset()
+	_ = c.zw.Close()
+	_, err := c.GunConn.Write(c.buf.Bytes())
+	return err
+}
+
+// withCompression returns a copy of header announcing compression.
+func withCompression(header http.Header, compression Compression) http.Header {
+	header = header.Clone()
+	value := compressionDeflate
+	if compression == CompressionLZ4 {
+		value = compressionLZ4
+	}
+	header[compressionHeader] = []string{value}
+	return header
+}
+
+// requestCompression returns the compression the client of request
+// announces, false if it is unknown.
+func requestCompression(request *http.Request) (Compression, bool) {
+	switch request.Header.Get(compressionHeader) {
+	case "":
+		return CompressionNone, true
+	case compressionLZ4:
+		return CompressionLZ4, true
+	case compressionDeflate:
+		return CompressionDeflate, true
+	}
+	return CompressionNone, false
+}
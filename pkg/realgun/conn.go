@@ -1,90 +1,467 @@
 package realgun
 
 import (
-	"bytes"
+	"bufio"
+	"context"
+	"crypto/rand"
 	"crypto/tls"
-	"errors"
+	"crypto/x509"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"log"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"runtime/pprof"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"ekyu.moe/leb128"
 	"encoding/binary"
 	"golang.org/x/net/http2"
 )
 
 type GunConn struct {
-	reader io.Reader
-	writer io.Writer
-	closer io.Closer
-	local  net.Addr
-	remote net.Addr
-	// mu protect done
-	mu   sync.Mutex
-	done chan struct{}
+	id uint64
+	// held is the number of bytes taken from the memory budget, accessed
+	// atomically
+	held int64
+	// bytesRead and bytesWritten count payload bytes, accessed atomically
+	bytesRead    int64
+	bytesWritten int64
+	created      time.Time
+	reader       io.Reader
+	writer       io.Writer
+	closer       io.Closer
+	local        net.Addr
+	remote       net.Addr
+	// mu protect done, trailer, sendTrailer and tag
+	mu          sync.Mutex
+	done        chan struct{}
+	trailer     http.Header
+	sendTrailer http.Header
+	tag         string
+	// ctx is cancelled when the stream dies
+	ctx    context.Context
+	cancel context.CancelFunc
 
 	toRead []byte
 	readAt int
+	// lenient accepts hunks whose protobuf length disagrees with the gRPC length.
+	lenient bool
+	// strict ends the stream on compressed messages, see StrictnessStrict
+	strict bool
+	// buffered is set when resynchronizing is enabled, and is then also
+	// reader, reading from rewound.
+	buffered *bufio.Reader
+	rewound  *rewindReader
+
+	// wmu protects pending, the write holding the write slot
+	wmu     sync.Mutex
+	pending *pendingWrite
+	// rmu protects readPending, the read readTimed runs in the background
+	rmu           sync.Mutex
+	readPending   *pendingRead
+	readDeadline  deadline
+	writeDeadline deadline
+
+	labels pprof.LabelSet
+	// timing and headerSent are guarded by mu
+	timing     DialTiming
+	headerSent time.Time
+	// sizer, if set, splits writes into hunks of adaptive size
+	sizer *hunkSizer
+	// drainTimeout, if positive, makes Close shut the stream down orderly
+	drainTimeout time.Duration
+	// sniffing, if set, is closed once the sniffer is done with the first
+	// bytes; sniffed is guarded by mu
+	sniffing chan struct{}
+	sniffed  string
+	// firstFlight, if positive, bounds the payload of the first hunk
+	firstFlight int
+	// maxWriteSize, if positive, bounds the payload of every hunk
+	maxWriteSize int
+	// qos, if set, schedules the writes of the streams of a Client by
+	// priority, which is accessed atomically
+	qos      *qosScheduler
+	priority int32
+	// qosSeen is the interactive write the stream last yielded to, see yield
+	qosSeen uint64
+	// writeClosed is set by CloseWrite, accessed atomically
+	writeClosed int32
+	// closeReason is guarded by mu
+	closeReason *CloseReason
+	// peerIdentity is set on accepted streams before they are handed out
+	peerIdentity *PeerIdentity
+	// user is set on accepted streams before they are handed out
+	user string
+	// readLimit and writeLimit, if set, pace the data of the stream
+	readLimit  *byteLimiter
+	writeLimit *byteLimiter
+
+	// onClose, if set, is called once by the first Close.
+	onClose func()
 }
 
 type Client struct {
-	client  *http.Client
-	url     *url.URL
-	headers http.Header
+	// activeStreams and openConns are accessed atomically and must stay
+	// 64-bit aligned.
+	activeStreams int64
+	openConns     int64
+
+	client       *http.Client
+	pool         *connPool
+	url          *url.URL
+	serviceName  string
+	hostHeader   string
+	headers      http.Header
+	profiles     []*HeaderProfile
+	randomPath   RandomPath
+	lenient      bool
+	resync       bool
+	adaptive     bool
+	middlewares  []Middleware
+	onDialTiming func(*GunConn, DialTiming)
+	limits       Limits
+	drainTimeout time.Duration
+	rateInterval time.Duration
+	onRate       RateFunc
+	compression  Compression
+	onConnState  func(ConnEvent)
+	qos          *qosScheduler
+	firstFlight  int
+	maxWriteSize int
+	// retryStatuses and maxRetries are set from Config, see roundTrip
+	retryStatuses []int
+	maxRetries    int
+	// dialTimeout and responseHeaderTimeout are set from Config
+	dialTimeout           time.Duration
+	responseHeaderTimeout time.Duration
+
+	// streamsMu protects streams
+	streamsMu sync.Mutex
+	streams   map[uint64]*GunConn
+	// done is closed when the client shuts down, see Close
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// RandomPath selects how the request path is varied between streams.
+type RandomPath int
+
+const (
+	// RandomPathNone requests the plain /{ServiceName}/Tun path.
+	RandomPathNone RandomPath = iota
+	// RandomPathSegment appends a random segment, as in /{ServiceName}/Tun/{random}.
+	RandomPathSegment
+	// RandomPathQuery appends a random query parameter, as in /{ServiceName}/Tun?r={random}.
+	RandomPathQuery
+)
+
+const randomPathQueryKey = "r"
+
+// Mode selects the gun method of the streams, and with it their messages.
+type Mode int
+
+const (
+	// ModeTun calls Tun, sending Hunk messages of one payload each.
+	ModeTun Mode = iota
+	// ModeMulti calls TunMulti, sending MultiHunk messages, which carry a list
+	// of payloads, as the multiMode of v2ray and Xray does. A MultiHunk of a
+	// single payload is encoded as the Hunk of that payload, so writes only
+	// differ by the method, while reads take the payloads of a message in
+	// order.
+	ModeMulti
+)
+
+// methodPath returns the default request path of mode.
+func (mode Mode) methodPath(serviceName string) string {
+	if mode == ModeMulti {
+		return fmt.Sprintf("/%s/TunMulti", serviceName)
+	}
+	return fmt.Sprintf("/%s/Tun", serviceName)
 }
 
 type Config struct {
 	RemoteAddr  string
 	ServerName  string
 	ServiceName string
-	Cleartext   bool
-	tlsConfig   *tls.Config
+	// Endpoints are further addresses of the server, tried in order when
+	// dialing RemoteAddr or the HTTP/2 handshake with it fails. Their hosts
+	// go into SNI unless ServerName is set, while :authority stays
+	// RemoteAddr, see HostHeader.
+	Endpoints []string
+	// RaceEndpoints dials RemoteAddr and all Endpoints at once instead, using
+	// the connection completing the HTTP/2 handshake first and closing the
+	// others, e.g. to cut the setup time on high-latency networks.
+	RaceEndpoints bool
+	// Cleartext speaks h2c with prior knowledge instead of TLS, e.g. to a
+	// server behind a TLS-terminating reverse proxy.
+	Cleartext bool
+	// Mode, ModeTun by default, selects the gun method, see Mode.
+	Mode Mode
+	// Path, if set, replaces the /{ServiceName}/Tun or /{ServiceName}/TunMulti
+	// request path of Mode, e.g. for servers with custom service and method
+	// names.
+	Path string
+	// HostHeader, if set, is sent as :authority instead of RemoteAddr, e.g.
+	// for domain fronting behind a CDN together with ServerName.
+	HostHeader string
+	// Headers are sent with every stream, replacing the headers of the same
+	// name of the header profile, e.g. to set a custom user-agent or the
+	// authentication headers of a CDN.
+	Headers http.Header
+	// RandomPath varies the request path per stream, so the URI is not a static fingerprint.
+	// The server must accept the varied paths, see MatchPath.
+	RandomPath RandomPath
+	// HeaderProfiles are the request header sets to impersonate. One is
+	// picked at random for every connection and used by all of its streams.
+	// Defaults to ProfileGrpcGo.
+	HeaderProfiles []*HeaderProfile
+	// LenientRead logs a warning instead of failing the stream with
+	// ErrInvalidLength when a peer pads hunks or declares a protobuf length
+	// that disagrees with the gRPC message length.
+	LenientRead bool
+	// Resync makes a stream skip forward to the next plausible hunk
+	// boundary instead of failing when it meets a malformed hunk, for links
+	// where broken middleboxes occasionally corrupt data.
+	Resync bool
+	// AdaptiveHunkSize splits writes into hunks whose size follows the
+	// traffic: small for interactive streams, growing for bulk transfers and
+	// shrinking again when writes stall.
+	AdaptiveHunkSize bool
+	// Middlewares wrap every dialed conn, first to last, e.g. to add
+	// encryption, accounting or recording.
+	Middlewares []Middleware
+	// KeepWarmInterval, if positive, sends a HEAD request to KeepWarmPath
+	// (default "/") at this interval while no stream is active, keeping CDN
+	// routing and the pooled connection warm.
+	KeepWarmInterval time.Duration
+	KeepWarmPath     string
+	// OnDialTiming, if set, is called with the phase timings of every
+	// stream once its response headers arrived.
+	OnDialTiming func(conn *GunConn, timing DialTiming)
+	// Limits caps the resources the client may use.
+	Limits Limits
+	// ReuseCheckAfter, if positive, makes a pooled connection that has been
+	// idle for longer than this get an HTTP/2 PING before it carries a new
+	// stream. If no answer arrives within ReuseCheckTimeout (default 5s), a
+	// fresh connection is dialed instead.
+	ReuseCheckAfter   time.Duration
+	ReuseCheckTimeout time.Duration
+	// DrainTimeout, if positive, makes Close finish pending writes, end the
+	// request and wait up to this long for the server's trailers before
+	// tearing the stream down.
+	DrainTimeout time.Duration
+	// OnRate, if set, is called every RateInterval (default 1s) with the
+	// current read and write rates of each stream, e.g. to drive bandwidth
+	// graphs.
+	OnRate       RateFunc
+	RateInterval time.Duration
+	// RetryStatuses lists the response statuses, e.g. 502 and 503 of a CDN,
+	// on which a stream is retried on another connection, up to MaxRetries
+	// times (default 1). Streams that wrote more than 64KiB before the status
+	// arrived are not retried.
+	RetryStatuses []int
+	MaxRetries    int
+	// RootCAs, if set, replaces the system roots for verifying the server,
+	// e.g. to trust a private CA. AllowInsecure skips verification entirely.
+	RootCAs       *x509.CertPool
+	AllowInsecure bool
+	// PinnedPublicKeys, if set, replaces certificate verification: only
+	// servers whose public key hashes, the SHA-256 of the certificate's
+	// SubjectPublicKeyInfo, are listed are trusted, whatever their name and
+	// issuer, like SSH host keys.
+	PinnedPublicKeys [][]byte
+	// PinnedPeerSHA256, if set, additionally requires one certificate of
+	// the chain presented by the server to be listed, by the SHA-256 of its
+	// SubjectPublicKeyInfo or of the whole DER certificate, like the
+	// pinnedPeerCertificateChainSha256 of Xray. Unlike PinnedPublicKeys it
+	// keeps the chain verification, so pinning the intermediate survives the
+	// frequent leaf rotation of CDNs.
+	PinnedPeerSHA256 [][]byte
+	// ClientCertificate and ClientKey, if set, are the PEM-encoded
+	// certificate chain and private key presented to servers requiring
+	// mutual TLS. A pair that does not parse fails the dials.
+	ClientCertificate []byte
+	ClientKey         []byte
+	// ReadIdleTimeout, if positive, makes the client send a PING on
+	// connections carrying streams nothing was received on for that long,
+	// and close them if no answer comes within PingTimeout (default 15s).
+	// PermitWithoutStream pings connections without streams as well, so
+	// CDNs dropping idle connections are detected before a stream needs
+	// them; see KeepWarmInterval to keep them open.
+	ReadIdleTimeout     time.Duration
+	PingTimeout         time.Duration
+	PermitWithoutStream bool
+	// FirstFlightSize, if positive, bounds the payload of the first message
+	// of every stream, so that its DATA frame fits in a single packet on
+	// paths with a small MTU, e.g. 1200. Larger writes continue in further
+	// messages.
+	FirstFlightSize int
+	// MaxWriteSize bounds the data of every message, splitting larger writes
+	// into several messages, as some servers and proxies reject a message of
+	// several megabytes. It defaults to 64KB, a negative value disables it.
+	MaxWriteSize int
+	// Compression, if set, compresses the data of every stream. Only
+	// gun-lite servers with Compression enabled understand it, other servers
+	// reject or corrupt such streams.
+	Compression Compression
+	// DialContext, if set, dials the raw connections to RemoteAddr instead of
+	// net.Dialer, e.g. to route them through a custom dialer.
+	DialContext DialContextFunc
+	// Socks5Proxy, if set, makes the connections go through a SOCKS5 proxy,
+	// dialed by way of DialContext. The proxy resolves RemoteAddr.
+	Socks5Proxy *Socks5Proxy
+	// HTTPProxy, if set, makes the connections go through an HTTP proxy with
+	// CONNECT, dialed by way of DialContext and Socks5Proxy.
+	HTTPProxy *HTTPProxy
+	// RemoteIPs, if set, are the addresses connections are made to instead of
+	// resolving the host of RemoteAddr, not of Endpoints, e.g. a curated set of CDN edges. The
+	// host still goes into SNI and :authority. Connections rotate over the
+	// set, and addresses failing to connect are only retried after the others.
+	RemoteIPs []string
+	// Resolver, if set, resolves the server addresses instead of the system
+	// resolver, e.g. to query a trusted DNS server. It is not used with
+	// DialContext or proxies, which resolve the addresses themselves.
+	Resolver *net.Resolver
+	// OnConnState, if set, is called with every state transition of the
+	// underlying connections, e.g. to show the tunnel status in a GUI. It
+	// must not block.
+	OnConnState func(ConnEvent)
+	// TLSConfig, if set, is used for the TLS connections to the server, e.g.
+	// to set RootCAs or client certificates. ServerName overrides its
+	// ServerName when set; h2 is always offered through ALPN.
+	TLSConfig *tls.Config
+	// SessionCache, if set, holds the TLS sessions resumed by reconnects,
+	// e.g. to share them across Clients, or NewFileSessionCache to keep them
+	// across restarts. Otherwise every Client caches up to
+	// SessionCacheSize sessions, 64 by default, unless TLSConfig brings a
+	// cache. A negative SessionCacheSize disables resumption.
+	SessionCache     tls.ClientSessionCache
+	SessionCacheSize int
+	// NextProtos, if set, is the ALPN protocol list offered to servers, e.g.
+	// h2 and http/1.1 as browsers do. h2 is added in front when missing, and
+	// servers choosing another protocol are rejected.
+	NextProtos []string
+	// DialTimeout, if positive, bounds setting up an underlying connection,
+	// from resolving the server address to the end of the handshakes.
+	// ResponseHeaderTimeout, if positive, bounds the wait for the response
+	// headers of every stream, e.g. for servers accepting connections behind
+	// a broken reverse proxy that never answers. Such streams report
+	// ErrTimeout on their first Read or Write.
+	DialTimeout           time.Duration
+	ResponseHeaderTimeout time.Duration
 }
 
 func NewGunClient(config *Config) *Client {
-	var dialFunc func(network, addr string, cfg *tls.Config) (net.Conn, error) = nil
+	dialContext := config.DialContext
+	if config.Socks5Proxy != nil {
+		dialContext = config.Socks5Proxy.dialContext(dialContext)
+	}
+	if config.HTTPProxy != nil {
+		dialContext = config.HTTPProxy.dialContext(dialContext)
+	}
+	dialer := &remoteDialer{dialContext: dialContext, resolver: config.Resolver}
+	if len(config.RemoteIPs) > 0 {
+		dialer.ips = newIPSet(config.RemoteAddr, append([]string(nil), config.RemoteIPs...))
+	}
+	var dialFunc timedDialFunc = nil
 	if config.Cleartext {
-		dialFunc = func(network, addr string, cfg *tls.Config) (net.Conn, error) {
-			return net.Dial(network, addr)
+		dialFunc = func(ctx context.Context, network, addr string, cfg *tls.Config, timing *DialTiming, _ *connState) (net.Conn, error) {
+			conn, err := dialer.dialTimed(ctx, network, addr, timing)
+			if err != nil {
+				return nil, &wrappedError{kind: ErrDialFailed, err: err}
+			}
+			return conn, nil
 		}
 	} else {
-		dialFunc = func(network, addr string, cfg *tls.Config) (net.Conn, error) {
-			pconn, err := net.Dial(network, addr)
+		dialFunc = func(ctx context.Context, network, addr string, cfg *tls.Config, timing *DialTiming, cs *connState) (net.Conn, error) {
+			pconn, err := dialer.dialTimed(ctx, network, addr, timing)
 			if err != nil {
-				return nil, err
+				return nil, &wrappedError{kind: ErrDialFailed, err: err}
 			}
+			cs.set(ConnTLSHandshake, nil)
 
+			start := time.Now()
 			cn := tls.Client(pconn, cfg)
+			// the handshake does not watch ctx
+			if deadline, ok := ctx.Deadline(); ok {
+				_ = pconn.SetDeadline(deadline)
+			}
 			if err := cn.Handshake(); err != nil {
-				return nil, err
+				_ = pconn.Close()
+				return nil, &wrappedError{kind: ErrHandshake, err: err}
 			}
+			_ = pconn.SetDeadline(time.Time{})
+			timing.TLSHandshake = time.Since(start)
 			state := cn.ConnectionState()
 			if p := state.NegotiatedProtocol; p != http2.NextProtoTLS {
-				return nil, errors.New("http2: unexpected ALPN protocol " + p + "; want q" + http2.NextProtoTLS)
+				_ = cn.Close()
+				return nil, &wrappedError{kind: ErrHandshake, err: fmt.Errorf("unexpected ALPN protocol %q; want %q", p, http2.NextProtoTLS)}
 			}
 			return cn, nil
 		}
 	}
 
-	if config.tlsConfig == nil && config.ServerName != "" {
-		config.tlsConfig = new(tls.Config)
-		config.tlsConfig.ServerName = config.ServerName
-		config.tlsConfig.NextProtos = []string{"h2"}
+	tlsConfig := config.TLSConfig.Clone()
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{NextProtos: []string{"h2"}}
+	}
+	if len(config.NextProtos) > 0 {
+		tlsConfig.NextProtos = append([]string(nil), config.NextProtos...)
+	}
+	if config.SessionCache != nil {
+		tlsConfig.ClientSessionCache = config.SessionCache
+	} else if config.SessionCacheSize < 0 {
+		tlsConfig.ClientSessionCache = nil
+	} else if tlsConfig.ClientSessionCache == nil {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(config.SessionCacheSize)
+	}
+	if config.ServerName != "" {
+		tlsConfig.ServerName = config.ServerName
+	}
+	if config.RootCAs != nil {
+		tlsConfig.RootCAs = config.RootCAs
+	}
+	if config.AllowInsecure {
+		tlsConfig.InsecureSkipVerify = true
+	}
+	if config.PinnedPublicKeys != nil || config.PinnedPeerSHA256 != nil {
+		pinCertificates(tlsConfig, config.PinnedPublicKeys, config.PinnedPeerSHA256)
+	}
+	if config.ClientCertificate != nil {
+		cert, err := tls.X509KeyPair(config.ClientCertificate, config.ClientKey)
+		tlsConfig.Certificates = nil
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if err != nil {
+				return nil, fmt.Errorf("realgun: client certificate: %w", err)
+			}
+			return &cert, nil
+		}
 	}
 
-	client := &http.Client{
-		Transport: &http2.Transport{
-			DialTLS:            dialFunc,
-			TLSClientConfig:    config.tlsConfig,
-			AllowHTTP:          false,
-			DisableCompression: true,
-			ReadIdleTimeout:    0,
-			PingTimeout:        0,
-		},
+	cli := &Client{
+		streams: make(map[uint64]*GunConn),
+		done:    make(chan struct{}),
+		qos:     new(qosScheduler),
+	}
+	// The transport grants servers fixed flow-control windows of 4MB per
+	// stream and 1GB per connection. The pinned x/net has no setting for
+	// them, so windows can only be tuned on the server, see ServerConfig.
+	transport := &http2.Transport{
+		TLSClientConfig:    tlsConfig,
+		AllowHTTP:          config.Cleartext,
+		DisableCompression: true,
+	}
+	cli.pool = newConnPool(transport, cli.trackConns(dialFunc), config)
+	transport.ConnPool = cli.pool
+	cli.client = &http.Client{
+		Transport: transport,
 	}
 
 	var serviceName = "GunService"
@@ -92,19 +469,92 @@ func NewGunClient(config *Config) *Client {
 		serviceName = config.ServiceName
 	}
 
-	return &Client{
-		client: client,
-		url: &url.URL{
-			Scheme: "https",
-			Host:   config.RemoteAddr,
-			Path:   fmt.Sprintf("/%s/Tun", serviceName),
-		},
-		headers: http.Header{
-			"content-type": []string{"application/grpc"},
-			"user-agent":   []string{"grpc-go/1.36.0"},
-			"te":           []string{"trailers"},
-		},
+	scheme := "https"
+	if config.Cleartext {
+		// prior-knowledge h2c, e.g. behind a TLS-terminating reverse proxy
+		scheme = "http"
+	}
+	path := config.Mode.methodPath(serviceName)
+	if config.Path != "" {
+		path = config.Path
+	}
+	cli.url = &url.URL{
+		Scheme: scheme,
+		Host:   config.RemoteAddr,
+		Path:   path,
+	}
+	cli.serviceName = serviceName
+	cli.hostHeader = config.HostHeader
+	cli.headers = mergeHeader(ProfileGrpcGo.Header, config.Headers)
+	cli.profiles = config.HeaderProfiles
+	if config.Headers != nil {
+		cli.profiles = make([]*HeaderProfile, len(config.HeaderProfiles))
+		for i, p := range config.HeaderProfiles {
+			cli.profiles[i] = &HeaderProfile{Name: p.Name, Header: mergeHeader(p.Header, config.Headers)}
+		}
+	}
+	cli.pool.profiles = cli.profiles
+	cli.randomPath = config.RandomPath
+	cli.lenient = config.LenientRead
+	cli.resync = config.Resync
+	cli.adaptive = config.AdaptiveHunkSize
+	cli.middlewares = config.Middlewares
+	cli.onDialTiming = config.OnDialTiming
+	cli.limits = config.Limits
+	cli.drainTimeout = config.DrainTimeout
+	cli.onRate = config.OnRate
+	cli.rateInterval = rateInterval(config.RateInterval)
+	cli.compression = config.Compression
+	cli.firstFlight = config.FirstFlightSize
+	cli.maxWriteSize = maxWriteSize(config.MaxWriteSize)
+	cli.onConnState = config.OnConnState
+	cli.retryStatuses = config.RetryStatuses
+	cli.maxRetries = config.MaxRetries
+	cli.dialTimeout = config.DialTimeout
+	cli.responseHeaderTimeout = config.ResponseHeaderTimeout
+	if cli.maxRetries <= 0 {
+		cli.maxRetries = defaultMaxRetries
+	}
+	if config.KeepWarmInterval > 0 {
+		keepWarmPath := "/"
+		if config.KeepWarmPath != "" {
+			keepWarmPath = config.KeepWarmPath
+		}
+		go cli.keepWarm(config.KeepWarmInterval, keepWarmPath)
+	}
+	return cli
+}
+
+// MatchPath reports whether requestPath addresses base, either exactly or
+// with a single random segment appended by RandomPathSegment. Query
+// parameters are not part of the path and need no special handling.
+func MatchPath(base, requestPath string) bool {
+	if requestPath == base {
+		return true
 	}
+	if !strings.HasPrefix(requestPath, base+"/") {
+		return false
+	}
+	suffix := requestPath[len(base)+1:]
+	return suffix != "" && !strings.Contains(suffix, "/")
+}
+
+func randomToken() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// streamURL returns the URL for a new stream.
+func (cli *Client) streamURL() *url.URL {
+	u := *cli.url
+	switch cli.randomPath {
+	case RandomPathSegment:
+		u.Path += "/" + randomToken()
+	case RandomPathQuery:
+		u.RawQuery = url.Values{randomPathQueryKey: []string{randomToken()}}.Encode()
+	}
+	return &u
 }
 
 type ChainedClosable []io.Closer
@@ -117,33 +567,148 @@ func (cc ChainedClosable) Close() error {
 	return nil
 }
 
+// DialConn opens a stream. It returns without waiting for the server: the
+// request is sent in the background, data written is sent right behind its
+// headers, and Read waits for the response. Errors of setting up the stream
+// are reported by the first Read or Write.
 func (cli *Client) DialConn() (net.Conn, error) {
+	return cli.DialConnContext(context.Background())
+}
+
+// DialConnContext opens a stream bound to ctx. Cancelling ctx aborts the dial
+// if it is still in flight and closes the stream otherwise.
+func (cli *Client) DialConnContext(ctx context.Context) (net.Conn, error) {
+	conn, err := cli.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if cli.compression != CompressionNone {
+		return applyMiddlewares(newCompressedConn(conn, cli.compression), cli.middlewares), nil
+	}
+	return applyMiddlewares(conn, cli.middlewares), nil
+}
+
+// dial opens a stream bound to ctx.
+func (cli *Client) dial(ctx context.Context) (*GunConn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if cli.isClosed() {
+		return nil, ErrClosed
+	}
+	if err := cli.admitStream(); err != nil {
+		return nil, err
+	}
 	reader, writer := io.Pipe()
 	request := &http.Request{
 		Method:     http.MethodPost,
 		Body:       reader,
-		URL:        cli.url,
+		URL:        cli.streamURL(),
+		Host:       cli.hostHeader,
 		Proto:      "HTTP/2",
 		ProtoMajor: 2,
 		ProtoMinor: 0,
-		Header:     cli.headers,
+		Header:     cli.requestHeader(),
+	}
+	if cli.compression != CompressionNone {
+		request.Header = withCompression(request.Header, cli.compression)
 	}
 	anotherReader, anotherWriter := io.Pipe()
-	go func() {
-		defer anotherWriter.Close()
-		response, err := cli.client.Do(request)
-		if err != nil {
-			return
+	conn := newGunConn(anotherReader, writer, ChainedClosable{reader, writer, anotherReader}, nil, nil)
+	conn.ctx, conn.cancel = context.WithCancel(ctx)
+	slot := new(streamSlot)
+	requestCtx := withProfileHeader(withStreamSlot(httptrace.WithClientTrace(conn.ctx, conn.timingTrace()), slot), cli.streamHeader)
+	request = request.WithContext(requestCtx)
+	conn.labels = pprof.Labels("endpoint", cli.url.Host, "service", cli.serviceName, "stream", strconv.FormatUint(conn.id, 10))
+	atomic.AddInt64(&resources.streams, 1)
+	go pprof.Do(conn.ctx, conn.labels, func(context.Context) {
+		defer atomic.AddInt64(&resources.streams, -1)
+		defer cli.pool.release(slot)
+		defer conn.cancel()
+		err := cli.pump(request, conn, anotherWriter)
+		_ = reader.CloseWithError(err)
+		_ = anotherWriter.CloseWithError(err)
+	})
+
+	conn.lenient = cli.lenient
+	if cli.resync {
+		conn.enableResync()
+	}
+	if cli.adaptive {
+		conn.sizer = newHunkSizer()
+	}
+	conn.drainTimeout = cli.drainTimeout
+	conn.qos = cli.qos
+	conn.firstFlight = cli.firstFlight
+	conn.maxWriteSize = cli.maxWriteSize
+	if cli.onRate != nil {
+		go conn.reportRates(cli.rateInterval, cli.onRate)
+	}
+	cli.addStream(conn)
+	conn.onClose = func() {
+		cli.removeStream(conn)
+		cli.pool.release(slot)
+		atomic.AddInt64(&cli.activeStreams, -1)
+	}
+	if ctx.Done() != nil {
+		go func() {
+			<-conn.ctx.Done()
+			if ctx.Err() != nil {
+				_ = conn.Close()
+			}
+		}()
+	}
+	return conn, nil
+}
+
+// pump performs the request of a stream and copies the response into w.
+func (cli *Client) pump(request *http.Request, conn *GunConn, w io.Writer) error {
+	var timer *time.Timer
+	if cli.responseHeaderTimeout > 0 {
+		timer = time.AfterFunc(cli.responseHeaderTimeout, conn.cancel)
+	}
+	response, err := cli.roundTrip(request, conn)
+	// the timeout only covers the response headers, not the stream
+	if timer != nil && !timer.Stop() {
+		if err == nil {
+			_ = response.Body.Close()
+		}
+		return fmt.Errorf("realgun: awaiting response headers: %w", ErrTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	conn.finishTiming()
+	if cli.onDialTiming != nil {
+		cli.onDialTiming(conn, conn.Timing())
+	}
+	if err := statusError(response); err != nil {
+		if response.StatusCode == http.StatusOK {
+			// trailers-only response
+			conn.setTrailer(response.Header)
 		}
-		_, _ = io.Copy(anotherWriter, response.Body)
-	}()
+		return err
+	}
+	if _, err = io.Copy(w, response.Body); err != nil {
+		return err
+	}
+	conn.setTrailer(response.Trailer)
+	return nil
+}
+
+// Middleware wraps a conn, e.g. to layer encryption or accounting on top.
+type Middleware func(net.Conn) net.Conn
 
-	return newGunConn(anotherReader, writer, ChainedClosable{reader, writer, anotherReader}, nil, nil), nil
+func applyMiddlewares(conn net.Conn, middlewares []Middleware) net.Conn {
+	for _, m := range middlewares {
+		conn = m(conn)
+	}
+	return conn
 }
 
-var (
-	ErrInvalidLength = errors.New("invalid length")
-)
+// lastStreamID is the ID of the most recently created GunConn.
+var lastStreamID uint64
 
 func newGunConn(reader io.Reader, writer io.Writer, closer io.Closer, local net.Addr, remote net.Addr) *GunConn {
 	if local == nil {
@@ -158,16 +723,63 @@ func newGunConn(reader io.Reader, writer io.Writer, closer io.Closer, local net.
 			Port: 0,
 		}
 	}
+	ctx, cancel := context.WithCancel(context.Background())
 	return &GunConn{
-		reader: reader,
-		writer: writer,
-		closer: closer,
-		local:  local,
-		remote: remote,
-		done:   make(chan struct{}),
+		id:      atomic.AddUint64(&lastStreamID, 1),
+		created: time.Now(),
+		reader:  reader,
+		writer:  writer,
+		closer:  closer,
+		local:   local,
+		remote:  remote,
+		done:    make(chan struct{}),
+		ctx:     ctx,
+		cancel:  cancel,
 	}
 }
 
+// ID returns the process-wide unique, monotonically increasing ID of the stream.
+func (g *GunConn) ID() uint64 {
+	return g.id
+}
+
+// String implements fmt.Stringer, for correlating log lines of one stream.
+func (g *GunConn) String() string {
+	return fmt.Sprintf("gun#%d", g.id)
+}
+
+// Labels returns the pprof labels (endpoint, service and stream ID) attached
+// to the goroutines serving the stream. Callers can apply them to their own
+// goroutines with pprof.Do.
+func (g *GunConn) Labels() pprof.LabelSet {
+	return g.labels
+}
+
+// Context returns a context that is cancelled when the stream dies, whether
+// by Close, a stream reset, GOAWAY or loss of the underlying connection. On
+// accepted streams it is derived from the context of the request, so
+// backends can abort their work the moment the client goes away.
+func (g *GunConn) Context() context.Context {
+	return g.ctx
+}
+
+// Trailer returns the trailer metadata sent by the server at the end of the
+// stream. It is nil until the response has been read to EOF.
+func (g *GunConn) Trailer() http.Header {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.trailer
+}
+
+func (g *GunConn) setTrailer(trailer http.Header) {
+	if reason := trailerReason(trailer); reason != nil {
+		g.setCloseReason(reason)
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.trailer = trailer
+}
+
 func (g *GunConn) isClosed() bool {
 	select {
 	case <-g.done:
@@ -178,54 +790,196 @@ func (g *GunConn) isClosed() bool {
 }
 
 func (g *GunConn) Read(b []byte) (n int, err error) {
+	if g.sniffing != nil {
+		<-g.sniffing
+	}
+	if g.readsTimed() {
+		n, err = g.readTimed(b)
+	} else {
+		n, err = g.read(b)
+	}
+	atomic.AddInt64(&g.bytesRead, int64(n))
+	g.throttle(g.readLimit, n)
+	if err != nil {
+		err = g.readError(err)
+	}
+	return n, err
+}
+
+func (g *GunConn) read(b []byte) (n int, err error) {
 	if g.toRead != nil {
 		n = copy(b, g.toRead[g.readAt:])
 		g.readAt += n
 		if g.readAt >= len(g.toRead) {
 			g.toRead = nil
+			g.releaseHeld()
 		}
 		return n, nil
 	}
-	buf := make([]byte, 5)
-	n, err = io.ReadFull(g.reader, buf)
+	if g.buffered != nil {
+		if err = g.syncToHunk(false); err != nil {
+			return 0, err
+		}
+	}
+	for {
+		payload, err := g.readHunk()
+		if err != nil {
+			g.releaseHeld()
+			return 0, err
+		}
+		if len(payload) == 0 && len(b) > 0 {
+			// empty message, nothing to return yet
+			g.releaseHeld()
+			continue
+		}
+		n = copy(b, payload)
+		if n < len(payload) {
+			g.toRead = payload
+			g.readAt = n
+		} else {
+			g.releaseHeld()
+		}
+		return n, nil
+	}
+}
+
+// readHunk reads the next message and returns its data, holding its size in
+// the memory budget.
+func (g *GunConn) readHunk() ([]byte, error) {
+	for {
+		header := make([]byte, 5)
+		_, err := io.ReadFull(g.reader, header)
+		if err != nil {
+			return nil, err
+		}
+		//log.Printf("GRPC Header: %x", header)
+		grpcPayloadLen := binary.BigEndian.Uint32(header[1:])
+		//log.Printf("GRPC Payload Length: %d", grpcPayloadLen)
+		if grpcPayloadLen > maxHunkSize {
+			return nil, ErrFrameTooLarge
+		}
+		if g.strict && header[0] != 0 {
+			g.setCloseReason(&CloseReason{Code: grpcInternal, Message: "compressed message without grpc-encoding"})
+			return nil, errCompressedMessage
+		}
+
+		if err = globalBudget.acquire(int64(grpcPayloadLen), g.done); err != nil {
+			return nil, err
+		}
+		atomic.StoreInt64(&g.held, int64(grpcPayloadLen))
+		buf := make([]byte, grpcPayloadLen)
+		if _, err = io.ReadFull(g.reader, buf); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		payload, tolerated, err := decodeHunk(buf, g.lenient)
+		if err != nil && g.buffered != nil {
+			// not a hunk after all, scan on from its second byte
+			log.Printf("realgun: %v: %v, resynchronizing", g, err)
+			g.releaseHeld()
+			g.rewind(append(header[1:], buf...))
+			if err = g.syncToHunk(true); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if tolerated {
+			log.Printf("realgun: %v: malformed gRPC message of %d bytes, reading %d bytes of data", g, grpcPayloadLen, len(payload))
+		}
+		return payload, nil
+	}
+}
+
+func (g *GunConn) Write(b []byte) (n int, err error) {
+	if g.writeDeadline.active() {
+		return g.writeTimed(b)
+	}
+	p, err := g.claimWrite(nil)
 	if err != nil {
 		return 0, err
 	}
-	//log.Printf("GRPC Header: %x", buf[:n])
-	grpcPayloadLen := binary.BigEndian.Uint32(buf[1:])
-	//log.Printf("GRPC Payload Length: %d", grpcPayloadLen)
+	defer g.releaseWrite(p)
+	return g.write(b)
+}
 
-	buf = make([]byte, grpcPayloadLen)
-	n, err = io.ReadFull(g.reader, buf)
-	if err != nil {
-		return 0, io.ErrUnexpectedEOF
+func (g *GunConn) write(b []byte) (n int, err error) {
+	if g.isClosed() || atomic.LoadInt32(&g.writeClosed) != 0 {
+		return 0, ErrClosed
 	}
-	protobufPayloadLen, protobufLengthLen := leb128.DecodeUleb128(buf[1:])
-	//log.Printf("Protobuf Payload Length: %d, Length Len: %d", protobufPayloadLen, protobufLengthLen)
-	if protobufLengthLen == 0 {
-		return 0, ErrInvalidLength
+	n, err = g.writeHunks(b)
+	atomic.AddInt64(&g.bytesWritten, int64(n))
+	g.throttle(g.writeLimit, n)
+	if err != nil && g.isClosed() {
+		err = ErrClosed
 	}
-	if grpcPayloadLen != uint32(protobufPayloadLen)+uint32(protobufLengthLen)+1 {
-		return 0, ErrInvalidLength
+	return n, err
+}
+
+func (g *GunConn) writeHunks(b []byte) (n int, err error) {
+	if g.firstFlight > 0 && len(b) > g.firstFlight {
+		size := g.firstFlight
+		g.firstFlight = 0
+		if n, err = g.writeHunks(b[:size]); err != nil {
+			return n, err
+		}
+		m, err := g.writeHunks(b[size:])
+		return n + m, err
 	}
-	n = copy(b, buf[1+protobufLengthLen:])
-	if n < int(protobufPayloadLen) {
-		g.toRead = buf
-		g.readAt = 1 + int(protobufLengthLen) + n
-		return n, nil
+	g.firstFlight = 0
+	bulk := g.qos != nil && g.Priority() == PriorityBulk
+	if bulk {
+		g.qos.beginBulk()
+		defer g.qos.endBulk()
+	} else if g.qos != nil && g.qos.beginInteractive() {
+		defer g.qos.endInteractive()
+	}
+	if g.sizer == nil && !bulk && (g.maxWriteSize <= 0 || len(b) <= g.maxWriteSize) {
+		return g.writeHunk(b)
+	}
+	if g.sizer != nil {
+		g.sizer.begin(time.Now())
+	}
+	for len(b) > 0 {
+		chunk := b
+		if g.sizer != nil && len(chunk) > g.sizer.size {
+			chunk = chunk[:g.sizer.size]
+		}
+		if g.maxWriteSize > 0 && len(chunk) > g.maxWriteSize {
+			chunk = chunk[:g.maxWriteSize]
+		}
+		if bulk {
+			if len(chunk) > bulkMaxHunkSize {
+				chunk = chunk[:bulkMaxHunkSize]
+			}
+			g.qos.yield(&g.qosSeen)
+		}
+		start := time.Now()
+		m, err := g.writeHunk(chunk)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		if g.sizer != nil {
+			g.sizer.observe(len(chunk), start, time.Now())
+		}
+		b = b[len(chunk):]
 	}
 	return n, nil
 }
 
-func (g *GunConn) Write(b []byte) (n int, err error) {
-	if g.isClosed() {
-		return 0, io.ErrClosedPipe
-	}
-	protobufHeader := leb128.AppendUleb128([]byte{0x0A}, uint64(len(b)))
-	grpcHeader := make([]byte, 5)
-	grpcPayloadLen := uint32(len(protobufHeader) + len(b))
-	binary.BigEndian.PutUint32(grpcHeader[1:5], grpcPayloadLen)
-	_, err = io.Copy(g.writer, io.MultiReader(bytes.NewReader(grpcHeader), bytes.NewReader(protobufHeader), bytes.NewReader(b)))
+// writeHunk writes b as one hunk, vectored on sockets and with a single Write
+// of a pooled buffer otherwise.
+func (g *GunConn) writeHunk(b []byte) (n int, err error) {
+	buf := getHunkBuffer()
+	hunk := appendHunkHeader(*buf, len(b))
+	vectored, err := writeVectored(g.writer, hunk, b)
+	if !vectored {
+		hunk = append(hunk, b...)
+		_, err = g.writer.Write(hunk)
+	}
+	putHunkBuffer(buf, hunk)
 	if f, ok := g.writer.(http.Flusher); ok {
 		f.Flush()
 	}
@@ -233,6 +987,10 @@ func (g *GunConn) Write(b []byte) (n int, err error) {
 }
 
 func (g *GunConn) Close() error {
+	return g.closeDraining(time.Now().Add(g.drainTimeout))
+}
+
+func (g *GunConn) close() error {
 	g.mu.Lock()
 	defer g.mu.Unlock()
 	select {
@@ -240,6 +998,11 @@ func (g *GunConn) Close() error {
 		return nil
 	default:
 		close(g.done)
+		g.cancel()
+		g.releaseHeld()
+		if g.onClose != nil {
+			g.onClose()
+		}
 		return g.closer.Close()
 	}
 }
@@ -252,14 +1015,50 @@ func (g *GunConn) RemoteAddr() net.Addr {
 	return g.remote
 }
 
+// CloseWrite ends the sending side of a dialed stream: the server reads EOF
+// while the response stays readable, like a TCP half-close. Later writes
+// fail with ErrClosed. Accepted streams cannot half-close, as their response
+// ends with the stream, and return an error.
+func (g *GunConn) CloseWrite() error {
+	p, err := g.claimWrite(nil)
+	if err != nil {
+		return err
+	}
+	defer g.releaseWrite(p)
+	w, ok := g.writer.(io.Closer)
+	if !ok {
+		return errCloseWriteUnsupported
+	}
+	atomic.StoreInt32(&g.writeClosed, 1)
+	return w.Close()
+}
+
+var _ interface{ CloseWrite() error } = (*GunConn)(nil)
+
+// SetDeadline sets both the read and the write deadline.
 func (g *GunConn) SetDeadline(t time.Time) error {
+	g.readDeadline.set(t)
+	g.writeDeadline.set(t)
 	return nil
 }
 
+// SetReadDeadline makes reads fail with ErrTimeout once they have been
+// blocked past t, including reads already blocked unless they started while
+// no deadline was set. The data a timed out read was waiting for is returned
+// by the next Read.
 func (g *GunConn) SetReadDeadline(t time.Time) error {
+	g.readDeadline.set(t)
 	return nil
 }
 
+// SetWriteDeadline makes writes fail with ErrTimeout once they have been
+// blocked past t, e.g. because the peer stopped granting flow-control window,
+// including writes already blocked unless they started while no deadline was
+// set.
+// A write whose hunk is already on its way when t passes returns len(b) and
+// no error instead: the hunk stays queued and goes out once the peer catches
+// up, keeping the stream consistent, and the following writes time out.
 func (g *GunConn) SetWriteDeadline(t time.Time) error {
+	g.writeDeadline.set(t)
 	return nil
 }
@@ -1,8 +1,35 @@
 package realgun
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
 	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
+	"time"
+
+	"ekyu.moe/leb128"
+	"golang.org/x/net/http2"
 )
 
 func Test(t *testing.T) {
@@ -19,3 +46,2097 @@ func Test(t *testing.T) {
 	_, err = io.Copy(conn, conn)
 	panic(err)
 }
+
+func TestMatchPath(t *testing.T) {
+	for _, c := range []struct {
+		path string
+		ok   bool
+	}{
+		{"/GunService/Tun", true},
+		{"/GunService/Tun/0123abcd", true},
+		{"/GunService/Tun/", false},
+		{"/GunService/Tun/a/b", false},
+		{"/GunService/TunMore", false},
+	} {
+		if got := MatchPath("/GunService/Tun", c.path); got != c.ok {
+			t.Errorf("MatchPath(%q) = %v, want %v", c.path, got, c.ok)
+		}
+	}
+}
+
+// hunk encodes payload as one gun message, with pad extra bytes after it.
+func hunk(payload []byte, pad int) []byte {
+	protobufHeader := leb128.AppendUleb128([]byte{0x0A}, uint64(len(payload)))
+	grpcHeader := make([]byte, 5)
+	binary.BigEndian.PutUint32(grpcHeader[1:], uint32(len(protobufHeader)+len(payload)+pad))
+	b := append(grpcHeader, protobufHeader...)
+	b = append(b, payload...)
+	return append(b, make([]byte, pad)...)
+}
+
+func TestLenientRead(t *testing.T) {
+	data := append(hunk([]byte("hello"), 3), hunk([]byte("world"), 0)...)
+
+	strict := newGunConn(bytes.NewReader(data), io.Discard, io.NopCloser(nil), nil, nil)
+	if _, err := strict.Read(make([]byte, 16)); !errors.Is(err, ErrInvalidLength) {
+		t.Fatalf("strict read: got %v, want ErrInvalidLength", err)
+	}
+
+	lenient := newGunConn(bytes.NewReader(data), io.Discard, io.NopCloser(nil), nil, nil)
+	lenient.lenient = true
+	got, err := io.ReadAll(lenient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "helloworld" {
+		t.Fatalf("lenient read: got %q", got)
+	}
+}
+
+func TestResyncMessages(t *testing.T) {
+	data := hunk(nil, 0)
+	// a message starting with another field than the data
+	data = append(data, 0x00, 0x00, 0x00, 0x00, 0x09, 0x10, 0x01, 0x0A, 0x05)
+	data = append(data, "hello"...)
+	// a plausible start of a message that does not parse
+	data = append(data, 0x00, 0x00, 0x00, 0x00, 0x04, 0x0A, 0x01, 'x', 0x00)
+	data = append(data, hunk([]byte("world"), 0)...)
+
+	conn := newGunConn(bytes.NewReader(data), io.Discard, io.NopCloser(nil), nil, nil)
+	conn.enableResync()
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "helloworld" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestResync(t *testing.T) {
+	data := append([]byte{0x00, 0xff, 0x13, 0x0A}, hunk([]byte("hello"), 0)...)
+	data = append(data, 0x01, 0x02)
+	data = append(data, hunk([]byte("world"), 0)...)
+
+	conn := newGunConn(bytes.NewReader(data), io.Discard, io.NopCloser(nil), nil, nil)
+	conn.enableResync()
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "helloworld" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestTryWrite(t *testing.T) {
+	pr, pw := io.Pipe()
+	conn := newGunConn(bytes.NewReader(nil), pw, pw, nil, nil)
+	if n, err := conn.TryWrite([]byte("hello")); err != nil || n != 5 {
+		t.Fatalf("first TryWrite: %d, %v", n, err)
+	}
+	if _, err := conn.TryWrite([]byte("world")); !errors.Is(err, ErrWouldBlock) {
+		t.Fatalf("second TryWrite: got %v, want ErrWouldBlock", err)
+	}
+
+	want := hunk([]byte("hello"), 0)
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(pr, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %x, want %x", got, want)
+	}
+	<-conn.Writable()
+	if _, err := conn.TryWrite([]byte("world")); err != nil {
+		t.Fatalf("TryWrite after Writable: %v", err)
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	SetMemoryBudget(8)
+	defer SetMemoryBudget(0)
+
+	data := append(hunk([]byte("hello"), 0), hunk([]byte("world"), 0)...)
+	first := newGunConn(bytes.NewReader(data), io.Discard, io.NopCloser(nil), nil, nil)
+	second := newGunConn(bytes.NewReader(data), io.Discard, io.NopCloser(nil), nil, nil)
+
+	if _, err := first.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = second.Read(make([]byte, 1))
+	}()
+	select {
+	case <-done:
+		t.Fatal("second stream read past the budget")
+	case <-time.After(50 * time.Millisecond):
+	}
+	first.Close()
+	<-done
+	second.Close()
+	if n := BufferedBytes(); n != 0 {
+		t.Fatalf("%d bytes still buffered", n)
+	}
+}
+
+func TestReadLongVarint(t *testing.T) {
+	payload := bytes.Repeat([]byte{0x42}, 1<<17)
+	conn := newGunConn(bytes.NewReader(hunk(payload, 0)), io.Discard, io.NopCloser(nil), nil, nil)
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("got %d bytes, want %d", len(got), len(payload))
+	}
+}
+
+func TestAdaptiveHunkSize(t *testing.T) {
+	var buf bytes.Buffer
+	conn := newGunConn(&buf, &buf, io.NopCloser(nil), nil, nil)
+	conn.sizer = newHunkSizer()
+	payload := bytes.Repeat([]byte{0x42}, 1<<20)
+	if n, err := conn.Write(payload); err != nil || n != len(payload) {
+		t.Fatalf("Write: %d, %v", n, err)
+	}
+	if conn.sizer.size != adaptiveMaxHunkSize {
+		t.Fatalf("hunk size %d after bulk write, want %d", conn.sizer.size, adaptiveMaxHunkSize)
+	}
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("got %d bytes back, want %d", len(got), len(payload))
+	}
+}
+
+func TestClosedErrors(t *testing.T) {
+	pr, pw := io.Pipe()
+	conn := newGunConn(pr, pw, ChainedClosable{pr, pw}, nil, nil)
+	conn.Close()
+	if _, err := conn.Write([]byte("hello")); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Write after Close: got %v, want net.ErrClosed", err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Read after Close: got %v, want ErrClosed", err)
+	}
+	var ne net.Error
+	if !errors.As(ErrTimeout, &ne) || !ne.Timeout() || !errors.Is(ErrTimeout, os.ErrDeadlineExceeded) {
+		t.Fatal("ErrTimeout is not a timeout net.Error")
+	}
+}
+
+func TestSharedClient(t *testing.T) {
+	a := SharedClient(&Config{RemoteAddr: "example.com:443", ServerName: "example.com"})
+	b := SharedClient(&Config{RemoteAddr: "example.com:443", ServerName: "example.com", ServiceName: "GunService"})
+	c := SharedClient(&Config{RemoteAddr: "example.com:443", ServerName: "example.com", ServiceName: "Other"})
+	if a != b {
+		t.Fatal("equivalent configs got different clients")
+	}
+	if a == c {
+		t.Fatal("different configs got the same client")
+	}
+}
+
+func TestMaxStreams(t *testing.T) {
+	cli := NewGunClient(&Config{RemoteAddr: "127.0.0.1:23333", Limits: Limits{MaxStreams: 1}})
+	if err := cli.admitStream(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.admitStream(); !errors.Is(err, ErrOverLimit) {
+		t.Fatalf("got %v, want ErrOverLimit", err)
+	}
+	if n := cli.NumActiveStreams(); n != 1 {
+		t.Fatalf("%d active streams, want 1", n)
+	}
+}
+
+func TestServerStream(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewGunServer(listener, &ServerConfig{})
+	defer server.Close()
+
+	body, bodyWriter := io.Pipe()
+	request := httptest.NewRequest(http.MethodPost, "/GunService/Tun", body)
+	request.Header.Set("content-type", "application/grpc")
+	recorder := httptest.NewRecorder()
+	handled := make(chan struct{})
+	go func() {
+		defer close(handled)
+		server.ServeHTTP(recorder, request)
+	}()
+	go func() {
+		_, _ = bodyWriter.Write(hunk([]byte("hello"), 0))
+	}()
+
+	conn, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 5)
+	if _, err = io.ReadFull(conn, got); err != nil || string(got) != "hello" {
+		t.Fatalf("read %q, %v", got, err)
+	}
+	if _, err = conn.Write([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	<-handled
+
+	response := recorder.Result()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", response.StatusCode)
+	}
+	if b, _ := io.ReadAll(response.Body); !bytes.Equal(b, hunk([]byte("world"), 0)) {
+		t.Fatalf("response body %x", b)
+	}
+	if s := response.Trailer.Get("grpc-status"); s != "0" {
+		t.Fatalf("grpc-status %q", s)
+	}
+}
+
+func TestLoopback(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewGunServer(listener, &ServerConfig{})
+	defer server.Close()
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	cli := NewGunClient(&Config{RemoteAddr: listener.Addr().String(), Cleartext: true, ResponseHeaderTimeout: 50 * time.Millisecond})
+	defer cli.Close()
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := cli.DialConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	// the echoes outlive ResponseHeaderTimeout
+	buf := make([]byte, 5)
+	for i := 0; i < 2; i++ {
+		for _, conn := range conns {
+			if _, err = conn.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+				t.Fatalf("echoed %q, %v", buf, err)
+			}
+		}
+		time.Sleep(150 * time.Millisecond)
+	}
+	if streams := cli.ConnStreams(); len(streams) != 1 || streams[0] != 2 {
+		t.Fatalf("streams per conn %v, want [2]", streams)
+	}
+	// the server echoes until EOF, then ends the stream
+	if _, err = conns[0].Write([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	if err = conns[0].(*GunConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(conns[0]); err != nil || string(b) != "world" {
+		t.Fatalf("read %q, %v after CloseWrite", b, err)
+	}
+	conns[0].Close()
+	deadline := time.Now().Add(time.Second)
+	for streams := cli.ConnStreams(); len(streams) != 1 || streams[0] != 1; streams = cli.ConnStreams() {
+		if time.Now().After(deadline) {
+			t.Fatalf("streams per conn %v after Close, want [1]", streams)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerNotFound(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewGunServer(listener, &ServerConfig{ServiceName: "Custom"})
+	defer server.Close()
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/GunService/Tun", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("status %d, want 404", recorder.Code)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	handler := NewHandler(&ServerConfig{}, func(conn net.Conn) {
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(conn, buf); err == nil {
+			_, _ = conn.Write(buf)
+		}
+	})
+
+	request := httptest.NewRequest(http.MethodPost, "/GunService/Tun", bytes.NewReader(hunk([]byte("hello"), 0)))
+	request.Header.Set("content-type", "application/grpc")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	response := recorder.Result()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", response.StatusCode)
+	}
+	if b, _ := io.ReadAll(response.Body); !bytes.Equal(b, hunk([]byte("hello"), 0)) {
+		t.Fatalf("response body %x", b)
+	}
+}
+
+func TestSniffHost(t *testing.T) {
+	pr, pw := net.Pipe()
+	go func() {
+		_ = tls.Client(pw, &tls.Config{ServerName: "example.com"}).Handshake()
+	}()
+	hello := make([]byte, 4096)
+	n, _ := pr.Read(hello)
+	pr.Close()
+
+	for _, c := range []struct {
+		head []byte
+		host string
+	}{
+		{hello[:n], "example.com"},
+		{[]byte("GET / HTTP/1.1\r\nHost: example.org\r\n\r\n"), "example.org"},
+		{[]byte("SSH-2.0-OpenSSH_8.4\r\n"), ""},
+	} {
+		if got := SniffHost(c.head); got != c.host {
+			t.Errorf("SniffHost(%q) = %q, want %q", c.head, got, c.host)
+		}
+	}
+}
+
+func TestHandlerSniffer(t *testing.T) {
+	sniffed := make(chan string, 1)
+	handler := NewHandler(&ServerConfig{Sniffer: SniffHost}, func(conn net.Conn) {
+		sniffed <- conn.(*GunConn).Sniffed()
+		_, _ = io.Copy(io.Discard, conn)
+	})
+	data := hunk([]byte("GET / HTTP/1.1\r\nHost: example.org\r\n\r\n"), 0)
+	request := httptest.NewRequest(http.MethodPost, "/GunService/Tun", bytes.NewReader(data))
+	request.Header.Set("content-type", "application/grpc")
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+	if got := <-sniffed; got != "example.org" {
+		t.Fatalf("sniffed %q", got)
+	}
+}
+
+func TestDialConnContextCanceled(t *testing.T) {
+	cli := NewGunClient(&Config{RemoteAddr: "127.0.0.1:23333"})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := cli.DialConnContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	if n := cli.NumActiveStreams(); n != 0 {
+		t.Fatalf("%d active streams, want 0", n)
+	}
+}
+
+func TestWriteDeadline(t *testing.T) {
+	pr, pw := io.Pipe()
+	conn := newGunConn(bytes.NewReader(nil), pw, pw, nil, nil)
+	conn.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	// the hunk stays queued, so the blocked Write reports it written
+	if n, err := conn.Write([]byte("hello")); err != nil || n != 5 {
+		t.Fatalf("blocked Write: %d, %v, want 5, nil", n, err)
+	}
+	if n, err := conn.Write([]byte("world")); !errors.Is(err, ErrTimeout) || n != 0 {
+		t.Fatalf("Write past deadline: got %d, %v, want 0, ErrTimeout", n, err)
+	}
+
+	want := hunk([]byte("hello"), 0)
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(pr, got); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("got %x, %v, want %x", got, err, want)
+	}
+	conn.SetWriteDeadline(time.Time{})
+	if conn.writeDeadline.active() {
+		t.Fatal("writes still timed after clearing the deadline")
+	}
+	go func() {
+		_, _ = io.ReadFull(pr, got)
+	}()
+	if _, err := conn.Write([]byte("world")); err != nil {
+		t.Fatalf("Write after clearing deadline: %v", err)
+	}
+}
+
+func TestPeerIdentity(t *testing.T) {
+	cert := &x509.Certificate{Raw: []byte("cert"), Subject: pkix.Name{CommonName: "alice"}}
+	identities := make(chan *PeerIdentity, 1)
+	handler := NewHandler(&ServerConfig{}, func(conn net.Conn) {
+		identities <- conn.(*GunConn).PeerIdentity()
+	})
+	request := httptest.NewRequest(http.MethodPost, "/GunService/Tun", bytes.NewReader(nil))
+	request.Header.Set("content-type", "application/grpc")
+	request.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+	id := <-identities
+	if id == nil || id.CommonName != "alice" || id.SHA256 != sha256.Sum256(cert.Raw) {
+		t.Fatalf("got identity %+v", id)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	tlsConfig := &tls.Config{RootCAs: x509.NewCertPool()}
+	cli := NewGunClient(&Config{RemoteAddr: "example.com:443", ServerName: "example.com", TLSConfig: tlsConfig})
+	got := cli.pool.transport.TLSClientConfig
+	if got.RootCAs != tlsConfig.RootCAs || got.ServerName != "example.com" {
+		t.Fatalf("transport TLS config %+v", got)
+	}
+	if tlsConfig.ServerName != "" {
+		t.Fatal("caller's TLSConfig was modified")
+	}
+}
+
+func TestReplayBody(t *testing.T) {
+	pr, pw := io.Pipe()
+	body := &replayBody{r: pr, replayable: true}
+	go func() {
+		_, _ = pw.Write([]byte("hello"))
+		_, _ = pw.Write([]byte("world"))
+		pw.Close()
+	}()
+
+	first := body.attempt()
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(first, got); err != nil || string(got) != "hello" {
+		t.Fatalf("first attempt read %q, %v", got, err)
+	}
+	if !body.rewind() {
+		t.Fatal("rewind failed")
+	}
+	if _, err := first.Read(got); !errors.Is(err, errStaleAttempt) {
+		t.Fatalf("superseded attempt read: got %v", err)
+	}
+	second := body.attempt()
+	body.commit()
+	all, err := io.ReadAll(second)
+	if err != nil || string(all) != "helloworld" {
+		t.Fatalf("second attempt read %q, %v", all, err)
+	}
+	if body.rewind() {
+		t.Fatal("rewind after commit succeeded")
+	}
+}
+
+func TestClientCertificateInvalid(t *testing.T) {
+	cli := NewGunClient(&Config{RemoteAddr: "example.com:443", ClientCertificate: []byte("junk"), ClientKey: []byte("junk")})
+	get := cli.pool.transport.TLSClientConfig.GetClientCertificate
+	if get == nil {
+		t.Fatal("no client certificate configured")
+	}
+	if _, err := get(&tls.CertificateRequestInfo{}); err == nil {
+		t.Fatal("invalid key pair accepted")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	for _, compression := range []Compression{CompressionLZ4, CompressionDeflate} {
+		pr, pw := io.Pipe()
+		a := newCompressedConn(newGunConn(bytes.NewReader(nil), pw, pw, nil, nil), compression)
+		b := newCompressedConn(newGunConn(pr, io.Discard, pr, nil, nil), compression)
+		payload := bytes.Repeat([]byte("hello "), 1000)
+		go func() {
+			_, _ = a.Write(payload)
+			_, _ = a.Write(payload[:100])
+			_ = a.Close()
+		}()
+		got, err := io.ReadAll(b)
+		if err != nil || !bytes.Equal(got, append(payload, payload[:100]...)) {
+			t.Fatalf("compression %d: read %d bytes, %v", compression, len(got), err)
+		}
+		if n := a.Info().BytesWritten; n >= int64(len(payload))/10 {
+			t.Fatalf("compression %d: %d bytes on the wire for %d bytes of data", compression, n, len(payload))
+		}
+	}
+}
+
+func TestLZ4Incompressible(t *testing.T) {
+	data := make([]byte, lz4MaxFrame+1000)
+	_, _ = rand.Read(data)
+	frames := appendLZ4Frames(nil, data)
+	if len(frames) > len(data)+16 {
+		t.Fatalf("%d bytes of frames for %d bytes of data", len(frames), len(data))
+	}
+	got, err := io.ReadAll(newLZ4Reader(bytes.NewReader(frames)))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes, %v", len(got), err)
+	}
+	if _, err = io.ReadAll(newLZ4Reader(bytes.NewReader([]byte{10, 3, 0x40, 1, 0}))); err != errCorruptLZ4 {
+		t.Fatalf("corrupt frame read with %v", err)
+	}
+}
+
+func TestDecodeCapture(t *testing.T) {
+	capture := append(hunk([]byte("hello"), 0), hunk(nil, 0)...)
+	capture = append(capture, hunk([]byte("world"), 0)...)
+	cli := NewGunClient(&Config{RemoteAddr: "127.0.0.1:23333"})
+	messages, err := cli.DecodeCapture(bytes.NewReader(capture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 3 || string(messages[0]) != "hello" || len(messages[1]) != 0 || string(messages[2]) != "world" {
+		t.Fatalf("got %q", messages)
+	}
+}
+
+func TestCleartext(t *testing.T) {
+	cli := NewGunClient(&Config{RemoteAddr: "127.0.0.1:23333", Cleartext: true})
+	if cli.url.Scheme != "http" || !cli.pool.transport.AllowHTTP {
+		t.Fatalf("scheme %q, AllowHTTP %v", cli.url.Scheme, cli.pool.transport.AllowHTTP)
+	}
+}
+
+func TestConnStateEvents(t *testing.T) {
+	var states []ConnState
+	cli := NewGunClient(&Config{RemoteAddr: "127.0.0.1:23333", OnConnState: func(e ConnEvent) {
+		states = append(states, e.State)
+	}})
+	dial := cli.trackConns(func(ctx context.Context, network, addr string, cfg *tls.Config, timing *DialTiming, cs *connState) (net.Conn, error) {
+		c, _ := net.Pipe()
+		return c, nil
+	})
+	conn, err := dial(context.Background(), "tcp", "127.0.0.1:23333", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if want := []ConnState{ConnDialing, ConnEstablished, ConnClosed}; len(states) != len(want) || states[0] != want[0] || states[1] != want[1] || states[2] != want[2] {
+		t.Fatalf("states %v, want %v", states, want)
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	var dialed string
+	cli := NewGunClient(&Config{RemoteAddr: "example.com:80", Cleartext: true, DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = addr
+		c, _ := net.Pipe()
+		return c, nil
+	}})
+	conn, err := cli.pool.dial(context.Background(), "tcp", "example.com:80", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if dialed != "example.com:80" {
+		t.Fatalf("dialed %q", dialed)
+	}
+}
+
+func TestHTTPProxy(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	requests := make(chan *http.Request, 1)
+	go func() {
+		c, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		request, err := http.ReadRequest(bufio.NewReader(c))
+		if err != nil {
+			return
+		}
+		requests <- request
+		_, _ = io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\nhello")
+	}()
+
+	proxy := &HTTPProxy{Addr: listener.Addr().String(), Username: "user", Password: "pass"}
+	conn, err := proxy.dialContext(nil)(context.Background(), "tcp", "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request := <-requests
+	if request.Method != http.MethodConnect || request.Host != "example.com:443" {
+		t.Fatalf("got %s %s", request.Method, request.Host)
+	}
+	if auth := request.Header.Get("Proxy-Authorization"); auth != "Basic dXNlcjpwYXNz" {
+		t.Fatalf("Proxy-Authorization %q", auth)
+	}
+	got := make([]byte, 5)
+	if _, err = io.ReadFull(conn, got); err != nil || string(got) != "hello" {
+		t.Fatalf("read %q, %v", got, err)
+	}
+}
+
+func TestBulkYield(t *testing.T) {
+	var qos qosScheduler
+	if qos.beginInteractive() {
+		t.Fatal("interactive write scheduled without bulk writes")
+	}
+	qos.beginBulk()
+	qos.beginInteractive()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		qos.endInteractive()
+	}()
+	start := time.Now()
+	qos.yield(new(uint64))
+	if d := time.Since(start); d < 10*time.Millisecond || d >= bulkMaxYield {
+		t.Fatalf("yielded for %v", d)
+	}
+
+	var buf bytes.Buffer
+	conn := newGunConn(&buf, &buf, io.NopCloser(nil), nil, nil)
+	conn.qos = &qos
+	conn.SetPriority(PriorityBulk)
+	qos.endBulk()
+	payload := bytes.Repeat([]byte{0x42}, 3*bulkMaxHunkSize)
+	if _, err := conn.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	// 5 bytes of gRPC header, the field tag and a 3-byte varint per hunk
+	if n := buf.Len() - len(payload); n != 3*(5+1+3) {
+		t.Fatalf("%d bytes of framing, want 3 hunks", n)
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	cli := NewGunClient(&Config{
+		RemoteAddr:     "example.com:443",
+		HeaderProfiles: []*HeaderProfile{ProfileGrpcJava},
+		Headers:        http.Header{"User-Agent": {"custom/1.0"}, "X-Token": {"secret"}},
+	})
+	header := cli.requestHeader()
+	if ua := header["user-agent"]; len(ua) != 1 || ua[0] != "custom/1.0" {
+		t.Fatalf("user-agent %q", ua)
+	}
+	if header["x-token"] == nil || header["te"] == nil {
+		t.Fatalf("header %v", header)
+	}
+	if ProfileGrpcJava.Header["user-agent"][0] == "custom/1.0" {
+		t.Fatal("built-in profile was modified")
+	}
+}
+
+func TestPinnedPublicKeys(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pin := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	var cfg tls.Config
+	pinCertificates(&cfg, [][]byte{pin[:]}, nil)
+	if err = cfg.VerifyPeerCertificate([][]byte{der}, nil); err != nil {
+		t.Fatalf("pinned key rejected: %v", err)
+	}
+	certPin := sha256.Sum256(der)
+	pinCertificates(&cfg, nil, [][]byte{certPin[:]})
+	if err = cfg.VerifyPeerCertificate([][]byte{der}, nil); err != nil {
+		t.Fatalf("pinned certificate rejected: %v", err)
+	}
+	pinCertificates(&cfg, [][]byte{certPin[:]}, nil)
+	if err = cfg.VerifyPeerCertificate([][]byte{der}, nil); !errors.Is(err, errPublicKeyMismatch) {
+		t.Fatalf("certificate hash accepted as public key hash: %v", err)
+	}
+	pinCertificates(&cfg, [][]byte{make([]byte, sha256.Size)}, nil)
+	if err = cfg.VerifyPeerCertificate([][]byte{der}, nil); !errors.Is(err, errPublicKeyMismatch) {
+		t.Fatalf("unpinned key: got %v", err)
+	}
+
+	// peer pins match any certificate of the chain and keep verification
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{SerialNumber: big.NewInt(2), NotAfter: time.Now().Add(time.Hour)}, cert, &leafKey.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg = tls.Config{}
+	pinCertificates(&cfg, nil, [][]byte{pin[:]})
+	if cfg.InsecureSkipVerify {
+		t.Fatal("peer pins skip verification")
+	}
+	if err = cfg.VerifyPeerCertificate([][]byte{leaf, der}, nil); err != nil {
+		t.Fatalf("pinned issuer rejected: %v", err)
+	}
+	if err = cfg.VerifyPeerCertificate([][]byte{leaf}, nil); !errors.Is(err, errPeerChainMismatch) {
+		t.Fatalf("chain without the pinned issuer: got %v", err)
+	}
+}
+
+func TestCloseWithReason(t *testing.T) {
+	handler := NewHandler(&ServerConfig{}, func(conn net.Conn) {
+		conn.(*GunConn).CloseWithReason(7, "quota exceeded: 100%")
+	})
+	request := httptest.NewRequest(http.MethodPost, "/GunService/Tun", bytes.NewReader(nil))
+	request.Header.Set("content-type", "application/grpc")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	response := recorder.Result()
+	reason := trailerReason(response.Trailer)
+	if reason == nil || reason.Code != 7 || reason.Message != "quota exceeded: 100%" || !reason.Remote {
+		t.Fatalf("got reason %+v from trailer %v", reason, response.Trailer)
+	}
+}
+
+func TestStreamLog(t *testing.T) {
+	logs := make(chan StreamLog, 1)
+	handler := NewHandler(&ServerConfig{OnStreamEnd: func(log StreamLog) { logs <- log }}, func(conn net.Conn) {
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(conn, buf); err == nil {
+			_, _ = conn.Write(buf[:3])
+		}
+		conn.(*GunConn).CloseWithReason(7, "denied")
+	})
+	request := httptest.NewRequest(http.MethodPost, "/GunService/Tun", bytes.NewReader(hunk([]byte("hello"), 0)))
+	request.Header.Set("content-type", "application/grpc")
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+
+	log := <-logs
+	if log.Path != "/GunService/Tun" || log.RemoteAddr.String() != request.RemoteAddr || log.BytesRead != 5 || log.BytesWritten != 3 {
+		t.Fatalf("log %+v", log)
+	}
+	if log.CloseReason == nil || log.CloseReason.Code != 7 || log.Duration <= 0 {
+		t.Fatalf("log %+v", log)
+	}
+}
+
+func TestStreamRate(t *testing.T) {
+	handler := NewHandler(&ServerConfig{
+		IPStreamRate:   RateLimit{Rate: 0.001, Burst: 2},
+		UserStreamRate: RateLimit{Rate: 0.001, Burst: 1},
+	}, func(net.Conn) {})
+	serve := func(remoteAddr, user string) string {
+		request := httptest.NewRequest(http.MethodPost, "/GunService/Tun", bytes.NewReader(nil))
+		request.Header.Set("content-type", "application/grpc")
+		request.RemoteAddr = remoteAddr
+		if user != "" {
+			cert := &x509.Certificate{Subject: pkix.Name{CommonName: user}}
+			request.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder.Result().Header.Get("grpc-status")
+	}
+	for i, want := range []string{"", "", "8"} {
+		if got := serve("192.0.2.1:1234", ""); got != want {
+			t.Fatalf("stream %d: grpc-status %q, want %q", i, got, want)
+		}
+	}
+	if got := serve("192.0.2.2:1234", "alice"); got != "" {
+		t.Fatalf("grpc-status %q for another client", got)
+	}
+	if got := serve("192.0.2.3:1234", "alice"); got != "8" {
+		t.Fatalf("grpc-status %q beyond the rate of the user", got)
+	}
+}
+
+func TestUserBandwidth(t *testing.T) {
+	l := newByteLimiter(10000)
+	start := time.Now()
+	// the burst lets the first 250ms worth through at once
+	l.wait(2500, nil)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("burst waited %v", elapsed)
+	}
+	l.wait(1000, nil)
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatalf("1000 bytes beyond the burst at 10000/s took %v", elapsed)
+	}
+
+	handler := NewHandler(&ServerConfig{UserUploadRate: 1000, UserDownloadRate: 1000}, func(net.Conn) {})
+	a, b := handler.acquireBandwidth("alice"), handler.acquireBandwidth("alice")
+	if a != b || a.upload == nil || a.download == nil {
+		t.Fatal("streams of a user do not share limiters")
+	}
+	handler.releaseBandwidth("alice")
+	handler.releaseBandwidth("alice")
+	if len(handler.bandwidth) != 0 {
+		t.Fatal("limiters kept after the last stream")
+	}
+}
+
+func TestStrictness(t *testing.T) {
+	var readErr error
+	serve := func(strictness Strictness, method, contentType, te string, body []byte) *http.Response {
+		handler := NewHandler(&ServerConfig{Strictness: strictness}, func(conn net.Conn) {
+			_, readErr = io.ReadAll(conn)
+		})
+		request := httptest.NewRequest(method, "/GunService/Tun", bytes.NewReader(body))
+		request.Header.Set("content-type", contentType)
+		if te != "" {
+			request.Header.Set("te", te)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder.Result()
+	}
+	if r := serve(StrictnessDefault, http.MethodGet, "application/grpc", "", nil); r.StatusCode != http.StatusNotFound {
+		t.Fatalf("default: status %d for GET", r.StatusCode)
+	}
+	if r := serve(StrictnessLenient, http.MethodGet, "text/plain", "", nil); r.StatusCode != http.StatusOK {
+		t.Fatalf("lenient: status %d", r.StatusCode)
+	}
+	if r := serve(StrictnessStrict, http.MethodPost, "application/grpc", "", nil); r.StatusCode != http.StatusBadRequest {
+		t.Fatalf("strict: status %d without te", r.StatusCode)
+	}
+	if r := serve(StrictnessStrict, http.MethodPost, "application/grpcfoo", "trailers", nil); r.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("strict: status %d for a wrong content type", r.StatusCode)
+	}
+	compressed := hunk([]byte("hello"), 0)
+	compressed[0] = 1
+	r := serve(StrictnessStrict, http.MethodPost, "application/grpc+proto", "trailers", compressed)
+	if r.StatusCode != http.StatusOK || readErr != errCompressedMessage || r.Trailer.Get("grpc-status") != "13" {
+		t.Fatalf("strict: status %d, read %v, trailer %v for a compressed message", r.StatusCode, readErr, r.Trailer)
+	}
+	if serve(StrictnessDefault, http.MethodPost, "application/grpc", "", compressed); readErr != nil {
+		t.Fatalf("default: read %v for a compressed message", readErr)
+	}
+}
+
+func TestForwardTo(t *testing.T) {
+	for _, network := range []string{"tcp", "unix"} {
+		addr := "127.0.0.1:0"
+		if network == "unix" {
+			addr = filepath.Join(t.TempDir(), "backend.sock")
+		}
+		backend, err := net.Listen(network, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer backend.Close()
+		go func() {
+			for {
+				c, err := backend.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					_, _ = io.Copy(c, c)
+					_ = c.Close()
+				}()
+			}
+		}()
+		target := backend.Addr().String()
+		if network == "unix" {
+			target = "unix:" + target
+		}
+		cli := NewGunClient(&Config{RemoteAddr: "example.com:443"})
+		cli.client.Transport = handlerTransport{NewHandler(&ServerConfig{ForwardTo: target}, nil)}
+		conn, err := cli.DialConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = conn.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, 5)
+		if _, err = io.ReadFull(conn, got); err != nil || string(got) != "hello" {
+			t.Fatalf("%s: read %q, %v", network, got, err)
+		}
+		conn.Close()
+	}
+
+	handler := NewHandler(&ServerConfig{ForwardTo: "unix:" + filepath.Join(t.TempDir(), "missing.sock")}, nil)
+	request := httptest.NewRequest(http.MethodPost, "/GunService/Tun", bytes.NewReader(nil))
+	request.Header.Set("content-type", "application/grpc")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if s := recorder.Result().Trailer.Get("grpc-status"); s != "14" {
+		t.Fatalf("grpc-status %q without a backend", s)
+	}
+}
+
+func TestDebugServices(t *testing.T) {
+	handler := NewHandler(&ServerConfig{DebugServices: true}, func(net.Conn) {
+		t.Error("debug stream handed to serve")
+	})
+	for _, service := range []string{"Echo", "Discard"} {
+		cli := NewGunClient(&Config{RemoteAddr: "example.com:443", Path: "/GunService/" + service})
+		cli.client.Transport = handlerTransport{handler}
+		conn, err := cli.DialConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = conn.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if err = conn.(*GunConn).CloseWrite(); err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(conn)
+		if want := map[string]string{"Echo": "hello", "Discard": ""}[service]; err != nil || string(got) != want {
+			t.Fatalf("%s: read %q, %v", service, got, err)
+		}
+		conn.Close()
+	}
+	recorder := httptest.NewRecorder()
+	NewHandler(&ServerConfig{}, func(net.Conn) {}).ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/GunService/Echo", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("status %d for Echo without DebugServices", recorder.Code)
+	}
+}
+
+func TestAddTrailer(t *testing.T) {
+	handler := NewHandler(&ServerConfig{}, func(conn net.Conn) {
+		conn.(*GunConn).AddTrailer("X-Bytes-Used", "42")
+		conn.(*GunConn).AddTrailer("grpc-status", "3")
+	})
+	request := httptest.NewRequest(http.MethodPost, "/GunService/Tun", bytes.NewReader(nil))
+	request.Header.Set("content-type", "application/grpc")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	trailer := recorder.Result().Trailer
+	if trailer.Get("x-bytes-used") != "42" || trailer.Get("grpc-status") != "0" {
+		t.Fatalf("trailer %v", trailer)
+	}
+}
+
+func TestServerStreamContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	body, bodyWriter := io.Pipe()
+	defer bodyWriter.Close()
+	request := httptest.NewRequest(http.MethodPost, "/GunService/Tun", body).WithContext(ctx)
+	request.Header.Set("content-type", "application/grpc")
+	accepted := make(chan *GunConn, 1)
+	handler := NewHandler(&ServerConfig{}, func(conn net.Conn) {
+		accepted <- conn.(*GunConn)
+		<-conn.(*GunConn).Context().Done()
+	})
+	handled := make(chan struct{})
+	go func() {
+		defer close(handled)
+		handler.ServeHTTP(httptest.NewRecorder(), request)
+	}()
+	conn := <-accepted
+	// the client resets the stream
+	cancel()
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("stream context not cancelled with the request")
+	}
+	if reason := conn.CloseReason(); reason == nil || reason.Code != grpcCanceled {
+		t.Fatalf("close reason %+v", reason)
+	}
+}
+
+func TestH2ServerTuning(t *testing.T) {
+	h2Server := newH2Server(&ServerConfig{MaxConcurrentStreams: 1000, MaxReadFrameSize: 1 << 20, IdleTimeout: time.Minute, InitialWindowSize: 1 << 20})
+	if h2Server.MaxConcurrentStreams != 1000 || h2Server.MaxReadFrameSize != 1<<20 || h2Server.IdleTimeout != time.Minute {
+		t.Fatalf("server %+v", h2Server)
+	}
+	if h2Server.MaxUploadBufferPerStream != 1<<20 || h2Server.MaxUploadBufferPerConnection != defaultInitialConnWindowSize {
+		t.Fatalf("windows %d, %d", h2Server.MaxUploadBufferPerStream, h2Server.MaxUploadBufferPerConnection)
+	}
+}
+
+func TestServerLimits(t *testing.T) {
+	release := make(chan struct{})
+	handler := NewHandler(&ServerConfig{Limits: Limits{MaxStreams: 1}}, func(net.Conn) { <-release })
+	serve := func() *http.Response {
+		request := httptest.NewRequest(http.MethodPost, "/GunService/Tun", bytes.NewReader(nil))
+		request.Header.Set("content-type", "application/grpc")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder.Result()
+	}
+	handled := make(chan struct{})
+	go func() {
+		defer close(handled)
+		serve()
+	}()
+	for atomic.LoadInt64(&handler.activeStreams) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if r := serve(); r.StatusCode != http.StatusOK || r.Header.Get("grpc-status") != "8" {
+		t.Fatalf("status %d, grpc-status %q beyond MaxStreams", r.StatusCode, r.Header.Get("grpc-status"))
+	}
+	close(release)
+	<-handled
+	if r := serve(); r.Header.Get("grpc-status") != "" {
+		t.Fatalf("grpc-status %q once the stream ended", r.Header.Get("grpc-status"))
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewGunServer(listener, &ServerConfig{Limits: Limits{MaxConns: 1}})
+	defer server.Close()
+	first, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	_ = second.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = second.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read %v on a connection beyond MaxConns", err)
+	}
+}
+
+func TestAdmit(t *testing.T) {
+	var infos []AdmissionInfo
+	handler := NewHandler(&ServerConfig{Admit: func(ctx context.Context, info AdmissionInfo) error {
+		infos = append(infos, info)
+		if len(infos) > 1 {
+			return errors.New("shedding load")
+		}
+		return nil
+	}}, func(net.Conn) {})
+	for _, want := range []string{"", "8"} {
+		request := httptest.NewRequest(http.MethodPost, "/GunService/Tun", bytes.NewReader(nil))
+		request.Header.Set("content-type", "application/grpc")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if got := recorder.Result().Header.Get("grpc-status"); got != want {
+			t.Fatalf("grpc-status %q, want %q", got, want)
+		}
+	}
+	if infos[1].Path != "/GunService/Tun" || infos[1].RemoteAddr.String() != "192.0.2.1:1234" || infos[1].ActiveStreams != 0 {
+		t.Fatalf("info %+v", infos[1])
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	users := make(chan string, 1)
+	handler := NewHandler(&ServerConfig{Authenticate: func(r *http.Request, identity *PeerIdentity) (string, error) {
+		if identity == nil {
+			return "", errors.New("client certificate required")
+		}
+		return "user-" + identity.CommonName, nil
+	}}, func(conn net.Conn) {
+		users <- conn.(*GunConn).User()
+	})
+	serve := func(tlsState *tls.ConnectionState) *http.Response {
+		request := httptest.NewRequest(http.MethodPost, "/GunService/Tun", bytes.NewReader(nil))
+		request.Header.Set("content-type", "application/grpc")
+		request.TLS = tlsState
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder.Result()
+	}
+	if r := serve(nil); r.Header.Get("grpc-status") != "16" || r.Header.Get("grpc-message") != "client certificate required" {
+		t.Fatalf("header %v without a certificate", r.Header)
+	}
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}}
+	if r := serve(&tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}); r.Header.Get("grpc-status") != "" {
+		t.Fatalf("header %v with a certificate", r.Header)
+	}
+	if user := <-users; user != "user-alice" {
+		t.Fatalf("user %q", user)
+	}
+}
+
+func TestFirstFlightSize(t *testing.T) {
+	var buf bytes.Buffer
+	conn := newGunConn(&buf, &buf, io.NopCloser(nil), nil, nil)
+	conn.firstFlight = 4
+	if _, err := conn.Write([]byte("helloworld")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	want := append(hunk([]byte("hell"), 0), hunk([]byte("oworld"), 0)...)
+	want = append(want, hunk([]byte("again"), 0)...)
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("got %x, want %x", buf.Bytes(), want)
+	}
+}
+
+func TestPath(t *testing.T) {
+	cli := NewGunClient(&Config{RemoteAddr: "example.com:443", Path: "/my.pkg.Svc/StreamData"})
+	if cli.url.Path != "/my.pkg.Svc/StreamData" {
+		t.Fatalf("path %q", cli.url.Path)
+	}
+	handler := NewHandler(&ServerConfig{Path: "/my.pkg.Svc/StreamData"}, func(net.Conn) {})
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/GunService/Tun", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("status %d for the default path, want 404", recorder.Code)
+	}
+}
+
+func TestNewServerConn(t *testing.T) {
+	request := httptest.NewRequest(http.MethodPost, "/GunService/Tun", bytes.NewReader(hunk([]byte("hello"), 0)))
+	var response bytes.Buffer
+	conn := NewServerConn(&ServerConfig{}, request, &response, nil)
+	defer conn.Close()
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "hello" {
+		t.Fatalf("read %q, %v", got, err)
+	}
+	if _, err := conn.Write([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(response.Bytes(), hunk([]byte("world"), 0)) {
+		t.Fatalf("response body %x", response.Bytes())
+	}
+}
+
+func TestRemoteIPs(t *testing.T) {
+	var dialed []string
+	cli := NewGunClient(&Config{RemoteAddr: "example.com:80", Cleartext: true, RemoteIPs: []string{"192.0.2.1", "192.0.2.2"},
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, addr)
+			if addr == "192.0.2.1:80" {
+				return nil, errors.New("unreachable")
+			}
+			c, _ := net.Pipe()
+			return c, nil
+		}})
+	for i := 0; i < 2; i++ {
+		conn, err := cli.pool.dial(context.Background(), "tcp", "example.com:80", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	// the failed address is tried after the healthy one on the second dial
+	want := []string{"192.0.2.1:80", "192.0.2.2:80", "192.0.2.2:80"}
+	if len(dialed) != len(want) {
+		t.Fatalf("dialed %q, want %q", dialed, want)
+	}
+	for i := range want {
+		if dialed[i] != want[i] {
+			t.Fatalf("dialed %q, want %q", dialed, want)
+		}
+	}
+}
+
+func TestRemoteIPsCanceled(t *testing.T) {
+	ips := newIPSet("example.com:80", []string{"192.0.2.1", "192.0.2.2"})
+	ctx, cancel := context.WithCancel(context.Background())
+	var dialed int
+	_, err := ips.dial(ctx, func(addr string) (net.Conn, error) {
+		dialed++
+		cancel()
+		return nil, ctx.Err()
+	}, "example.com:80")
+	if !errors.Is(err, context.Canceled) || dialed != 1 {
+		t.Fatalf("dial returned %v after %d dials", err, dialed)
+	}
+	for i, failedAt := range ips.failedAt {
+		if !failedAt.IsZero() {
+			t.Fatalf("address %d marked failed by the cancellation", i)
+		}
+	}
+}
+
+func TestMaxStreamsPerConn(t *testing.T) {
+	cli := NewGunClient(&Config{RemoteAddr: "example.com:443", Limits: Limits{MaxStreamsPerConn: 2}})
+	p := cli.pool
+	first, second := new(pooledConn), new(pooledConn)
+	slots := []*streamSlot{new(streamSlot), new(streamSlot), new(streamSlot)}
+	p.mu.Lock()
+	p.conns["example.com:443"] = []*pooledConn{first, second}
+	p.place(slots[0], first)
+	p.place(slots[1], first)
+	if p.hasRoom(first, slots[2]) || !p.hasRoom(first, slots[0]) || !p.hasRoom(second, slots[2]) {
+		t.Fatal("wrong room with two streams on the first conn")
+	}
+	p.place(slots[2], second)
+	p.mu.Unlock()
+	p.release(slots[0])
+	if first.streams != 1 || second.streams != 1 {
+		t.Fatalf("streams %d and %d after release, want 1 and 1", first.streams, second.streams)
+	}
+	if got := cli.ConnStreams(); len(got) != 2 {
+		t.Fatalf("ConnStreams %v", got)
+	}
+}
+
+func TestReleaseBeforePlace(t *testing.T) {
+	cli := NewGunClient(&Config{RemoteAddr: "example.com:443"})
+	p := cli.pool
+	pc := &pooledConn{cc: new(http2.ClientConn)}
+	p.conns["example.com:443"] = []*pooledConn{pc}
+	slot := new(streamSlot)
+	p.release(slot)
+	ctx, cancel := context.WithCancel(withStreamSlot(context.Background(), slot))
+	cancel()
+	request, _ := http.NewRequestWithContext(ctx, http.MethodPost, "https://example.com/GunService/Tun", nil)
+	if _, err := p.GetClientConn(request, "example.com:443"); err != nil {
+		t.Fatal(err)
+	}
+	if pc.streams != 0 {
+		t.Fatalf("%d streams on the conn after the stream was released", pc.streams)
+	}
+}
+
+func TestEndpointsFailover(t *testing.T) {
+	var dialed []string
+	cli := NewGunClient(&Config{RemoteAddr: "a.example:80", Endpoints: []string{"b.example:80", "c.example:80"}, Cleartext: true,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, addr)
+			return nil, errors.New("unreachable")
+		}})
+	if _, err := cli.pool.dialNew(context.Background(), "a.example:80", nil); err == nil {
+		t.Fatal("dial succeeded")
+	}
+	if len(dialed) != 3 || dialed[0] != "a.example:80" || dialed[1] != "b.example:80" || dialed[2] != "c.example:80" {
+		t.Fatalf("dialed %q", dialed)
+	}
+}
+
+func TestRaceEndpoints(t *testing.T) {
+	var mu sync.Mutex
+	var dialed []string
+	cli := NewGunClient(&Config{RemoteAddr: "a.example:80", Endpoints: []string{"b.example:80"}, RaceEndpoints: true, Cleartext: true,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			mu.Lock()
+			dialed = append(dialed, addr)
+			mu.Unlock()
+			return nil, errors.New("unreachable")
+		}})
+	if _, err := cli.pool.dialNew(context.Background(), "a.example:80", nil); err == nil {
+		t.Fatal("dial succeeded")
+	}
+	if len(dialed) != 2 {
+		t.Fatalf("dialed %q", dialed)
+	}
+}
+
+func TestDialTiming(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	var timing DialTiming
+	conn, err := new(remoteDialer).dialTimed(context.Background(), "tcp", net.JoinHostPort("localhost", port), &timing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if timing.DNS < 0 || timing.Connect <= 0 {
+		t.Fatalf("timing %+v", timing)
+	}
+}
+
+func TestResolver(t *testing.T) {
+	var queried bool
+	resolver := &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+		queried = true
+		return nil, errors.New("no DNS")
+	}}
+	cli := NewGunClient(&Config{RemoteAddr: "resolver-test.example:80", Cleartext: true, Resolver: resolver})
+	if _, err := cli.pool.dial(context.Background(), "tcp", "resolver-test.example:80", nil); err == nil {
+		t.Fatal("dial succeeded")
+	}
+	if !queried {
+		t.Fatal("resolver not used")
+	}
+}
+
+func TestDoHResolver(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, _ := io.ReadAll(r.Body)
+		if r.Header.Get("content-type") != "application/dns-message" || len(query) < 12 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// answer A questions with 192.0.2.1 and others with nothing
+		end := 12
+		for query[end] != 0 {
+			end += int(query[end]) + 1
+		}
+		end += 5
+		answer := append([]byte(nil), query[:end]...)
+		binary.BigEndian.PutUint16(answer[2:], 0x8180)
+		binary.BigEndian.PutUint16(answer[6:], 0)
+		binary.BigEndian.PutUint16(answer[10:], 0)
+		if binary.BigEndian.Uint16(query[end-4:]) == 1 {
+			binary.BigEndian.PutUint16(answer[6:], 1)
+			answer = append(answer, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 192, 0, 2, 1)
+		}
+		w.Header().Set("content-type", "application/dns-message")
+		w.Write(answer)
+	}))
+	defer server.Close()
+	resolver := NewDoHResolver(server.URL+"/dns-query", server.Client())
+	addrs, err := resolver.LookupHost(context.Background(), "doh-test.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != "192.0.2.1" {
+		t.Fatalf("resolved %q", addrs)
+	}
+}
+
+func TestSessionCache(t *testing.T) {
+	cli := NewGunClient(&Config{RemoteAddr: "example.com:443"})
+	if cli.pool.transport.TLSClientConfig.ClientSessionCache == nil {
+		t.Fatal("no session cache by default")
+	}
+	cache := tls.NewLRUClientSessionCache(8)
+	a := NewGunClient(&Config{RemoteAddr: "a.example:443", SessionCache: cache})
+	b := NewGunClient(&Config{RemoteAddr: "b.example:443", SessionCache: cache})
+	if a.pool.transport.TLSClientConfig.ClientSessionCache != cache || b.pool.transport.TLSClientConfig.ClientSessionCache != cache {
+		t.Fatal("session cache not shared")
+	}
+	cli = NewGunClient(&Config{RemoteAddr: "example.com:443", SessionCacheSize: -1})
+	if cli.pool.transport.TLSClientConfig.ClientSessionCache != nil {
+		t.Fatal("session cache not disabled")
+	}
+}
+
+func TestNextProtos(t *testing.T) {
+	cli := NewGunClient(&Config{RemoteAddr: "example.com:443", NextProtos: []string{"http/1.1"}})
+	var offered []string
+	cli.pool.dial = func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+		offered = cfg.NextProtos
+		return nil, errors.New("unreachable")
+	}
+	if _, err := cli.pool.dialNew(context.Background(), "example.com:443", nil); err == nil {
+		t.Fatal("dial succeeded")
+	}
+	if len(offered) != 2 || offered[0] != "h2" || offered[1] != "http/1.1" {
+		t.Fatalf("offered %q", offered)
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	ok := &http.Response{StatusCode: http.StatusOK, Status: "200 OK", Header: http.Header{"Grpc-Status": {"0"}}}
+	if err := statusError(ok); err != nil {
+		t.Fatalf("accepted stream failed: %v", err)
+	}
+	refused := &http.Response{StatusCode: http.StatusOK, Status: "200 OK", Header: http.Header{"Grpc-Status": {"16"}, "Grpc-Message": {"bad%20token"}}}
+	var e *StatusError
+	if err := statusError(refused); !errors.As(err, &e) || e.GrpcStatus != 16 || e.GrpcMessage != "bad token" {
+		t.Fatalf("trailers-only refusal: %v", err)
+	}
+	notFound := &http.Response{StatusCode: http.StatusNotFound, Status: "404 Not Found", Header: http.Header{}}
+	if err := statusError(notFound); !errors.As(err, &e) || e.StatusCode != http.StatusNotFound || e.GrpcStatus != -1 {
+		t.Fatalf("404: %v", err)
+	}
+}
+
+func TestErrorKinds(t *testing.T) {
+	refused := errors.New("connection refused")
+	cli := NewGunClient(&Config{RemoteAddr: "example.com:80", Cleartext: true, DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, refused
+	}})
+	_, err := cli.pool.dial(context.Background(), "tcp", "example.com:80", nil)
+	if !errors.Is(err, ErrDialFailed) || !errors.Is(err, refused) {
+		t.Fatalf("dial error %v", err)
+	}
+	if msg := err.Error(); msg != "realgun: dial failed: connection refused" {
+		t.Fatalf("dial error message %q", msg)
+	}
+	for _, err := range []error{ErrInvalidLength, ErrFrameTooLarge, ErrDialFailed, ErrHandshake, ErrClosed, ErrTimeout, ErrWouldBlock, ErrOverLimit} {
+		if !strings.HasPrefix(err.Error(), "realgun: ") {
+			t.Fatalf("error message %q without prefix", err)
+		}
+	}
+
+	header := []byte{0, 0xff, 0xff, 0xff, 0xff}
+	conn := newGunConn(bytes.NewReader(header), io.Discard, io.NopCloser(nil), nil, nil)
+	defer conn.Close()
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("read error %v", err)
+	}
+}
+
+func TestClientClose(t *testing.T) {
+	config := &Config{RemoteAddr: "close-test.example:443"}
+	cli := SharedClient(config)
+	if err := cli.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.DialConn(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("dial after Close: %v", err)
+	}
+	if SharedClient(config) == cli {
+		t.Fatal("closed Client still shared")
+	}
+}
+
+func TestClientCloseDrains(t *testing.T) {
+	handler := NewHandler(&ServerConfig{}, func(conn net.Conn) {
+		// never end the response, so every drain runs into the deadline
+		_, _ = io.Copy(io.Discard, conn)
+		<-conn.(*GunConn).Context().Done()
+	})
+	cli := NewGunClient(&Config{RemoteAddr: "example.com:443", DrainTimeout: 200 * time.Millisecond})
+	cli.client.Transport = handlerTransport{handler}
+	for i := 0; i < 3; i++ {
+		conn, err := cli.DialConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = conn.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now()
+	_ = cli.Close()
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > 400*time.Millisecond {
+		t.Fatalf("Close of 3 draining streams took %v, want one DrainTimeout", elapsed)
+	}
+}
+
+func TestDialAfterClose(t *testing.T) {
+	var dialed net.Conn
+	cli := NewGunClient(&Config{RemoteAddr: "example.com:80", Cleartext: true,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			c, _ := net.Pipe()
+			dialed = c
+			return c, nil
+		}})
+	_ = cli.Close()
+	if _, err := cli.pool.dialNew(context.Background(), "example.com:80", nil); !errors.Is(err, ErrClosed) {
+		t.Fatalf("dial after Close: %v", err)
+	}
+	if len(cli.pool.conns) != 0 {
+		t.Fatal("connection pooled after Close")
+	}
+	if _, err := dialed.Write([]byte{0}); err == nil {
+		t.Fatal("connection dialed after Close left open")
+	}
+}
+
+func TestPermitWithoutStream(t *testing.T) {
+	for _, permit := range []bool{false, true} {
+		cli := NewGunClient(&Config{RemoteAddr: "example.com:80", Cleartext: true,
+			ReadIdleTimeout: 20 * time.Millisecond, PingTimeout: time.Second, PermitWithoutStream: permit,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				c, _ := net.Pipe()
+				return c, nil
+			}})
+		pc, err := cli.pool.dialNew(context.Background(), "example.com:80", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// pings fail from now on
+		_ = pc.cc.Close()
+		time.Sleep(100 * time.Millisecond)
+		cli.pool.mu.Lock()
+		pooled := cli.pool.pooled(pc)
+		cli.pool.mu.Unlock()
+		if pooled != !permit {
+			t.Fatalf("PermitWithoutStream %v: connection without streams pooled %v", permit, pooled)
+		}
+		_ = cli.Close()
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	cli := NewGunClient(&Config{RemoteAddr: "example.com:80", Cleartext: true, DialTimeout: 50 * time.Millisecond,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}})
+	start := time.Now()
+	_, err := cli.pool.dial(context.Background(), "tcp", "example.com:80", nil)
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > time.Second {
+		t.Fatalf("dial returned %v after %v", err, time.Since(start))
+	}
+}
+
+func TestResponseHeaderTimeoutOutlived(t *testing.T) {
+	cli := echoClient(&Config{RemoteAddr: "example.com:443", ResponseHeaderTimeout: 50 * time.Millisecond}, &ServerConfig{})
+	defer cli.Close()
+	conn, err := cli.DialConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 5)
+	for i := 0; i < 2; i++ {
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(150 * time.Millisecond)
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	pr, pw := io.Pipe()
+	conn := newGunConn(pr, io.Discard, pr, nil, nil)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Hour))
+	errs := make(chan error)
+	go func() {
+		_, err := conn.Read(make([]byte, 5))
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	conn.SetReadDeadline(time.Now())
+	if err := <-errs; !errors.Is(err, ErrTimeout) {
+		t.Fatalf("blocked Read: got %v, want ErrTimeout", err)
+	}
+
+	conn.SetReadDeadline(time.Time{})
+	go pw.Write(hunk([]byte("hello"), 0))
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "hello" {
+		t.Fatalf("read %q, %v after clearing the deadline", got, err)
+	}
+	if conn.readsTimed() {
+		t.Fatal("reads still timed after clearing the deadline")
+	}
+}
+
+func TestCloseWrite(t *testing.T) {
+	pr, pw := io.Pipe()
+	conn := newGunConn(bytes.NewReader(hunk([]byte("hello"), 0)), pw, pw, nil, nil)
+	defer conn.Close()
+	go conn.Write([]byte("ping"))
+	if got, err := io.ReadAll(io.LimitReader(pr, int64(len(hunk([]byte("ping"), 0))))); err != nil || !bytes.Equal(got, hunk([]byte("ping"), 0)) {
+		t.Fatalf("request body %x, %v", got, err)
+	}
+	if err := conn.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pr.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("request body after CloseWrite: %v, want EOF", err)
+	}
+	if _, err := conn.Write([]byte("late")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Write after CloseWrite: %v", err)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "hello" {
+		t.Fatalf("read %q, %v after CloseWrite", got, err)
+	}
+}
+
+func TestReadSmallBuffer(t *testing.T) {
+	stream := append(hunk([]byte("hello"), 0), hunk([]byte("world"), 0)...)
+	conn := newGunConn(bytes.NewReader(stream), io.Discard, io.NopCloser(nil), nil, nil)
+	defer conn.Close()
+	var got []byte
+	b := make([]byte, 2)
+	for len(got) < 10 {
+		n, err := conn.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, b[:n]...)
+	}
+	if string(got) != "helloworld" {
+		t.Fatalf("read %q", got)
+	}
+}
+
+func TestDecodeHunk(t *testing.T) {
+	// an unknown varint field 2, then data split over two fields
+	msg := []byte{0x10, 0x96, 0x01, 0x0A, 2, 'h', 'e', 0x0A, 3, 'l', 'l', 'o'}
+	data, tolerated, err := decodeHunk(msg, false)
+	if err != nil || tolerated || string(data) != "hello" {
+		t.Fatalf("got %q, %v, %v", data, tolerated, err)
+	}
+	if _, _, err := decodeHunk([]byte{0x0A, 9, 'h', 'i'}, false); !errors.Is(err, ErrInvalidLength) {
+		t.Fatalf("overrunning field: %v", err)
+	}
+	if data, tolerated, err := decodeHunk([]byte{0x0A, 9, 'h', 'i'}, true); err != nil || !tolerated || string(data) != "hi" {
+		t.Fatalf("lenient overrunning field: %q, %v, %v", data, tolerated, err)
+	}
+
+	// hunks arriving one byte at a time
+	stream := append(hunk([]byte("hello"), 0), hunk(nil, 0)...)
+	stream = append(stream, hunk([]byte("world"), 0)...)
+	conn := newGunConn(iotest.OneByteReader(bytes.NewReader(stream)), io.Discard, io.NopCloser(nil), nil, nil)
+	defer conn.Close()
+	got := make([]byte, 10)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "helloworld" {
+		t.Fatalf("read %q, %v", got, err)
+	}
+}
+
+func TestWriteHunkAllocs(t *testing.T) {
+	var out bytes.Buffer
+	conn := newGunConn(bytes.NewReader(nil), &out, io.NopCloser(nil), nil, nil)
+	defer conn.Close()
+	payload := bytes.Repeat([]byte("x"), 300)
+	if _, err := conn.writeHunk(payload); err != nil || !bytes.Equal(out.Bytes(), hunk(payload, 0)) {
+		t.Fatalf("wrote %x, %v", out.Bytes(), err)
+	}
+	conn.writer = io.Discard
+	if allocs := testing.AllocsPerRun(100, func() { _, _ = conn.writeHunk(payload) }); allocs > 0 {
+		t.Fatalf("%v allocations per hunk", allocs)
+	}
+}
+
+func TestWriteHunkVectored(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	conn := newGunConn(bytes.NewReader(nil), &serverWriter{w: client}, io.NopCloser(nil), nil, nil)
+	payload := bytes.Repeat([]byte("x"), 300)
+	if _, err := conn.writeHunk(payload); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	got, err := io.ReadAll(server)
+	if err != nil || !bytes.Equal(got, hunk(payload, 0)) {
+		t.Fatalf("read %x, %v", got, err)
+	}
+}
+
+func TestReadFromWriteTo(t *testing.T) {
+	var out bytes.Buffer
+	conn := newGunConn(bytes.NewReader(nil), &out, io.NopCloser(nil), nil, nil)
+	defer conn.Close()
+	payload := bytes.Repeat([]byte("x"), readFromSize+100)
+	if n, err := conn.ReadFrom(bytes.NewReader(payload)); err != nil || n != int64(len(payload)) {
+		t.Fatalf("ReadFrom = %v, %v", n, err)
+	}
+	want := append(hunk(payload[:readFromSize], 0), hunk(payload[readFromSize:], 0)...)
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Fatalf("wrote %d bytes, want %d", out.Len(), len(want))
+	}
+
+	in := append(hunk([]byte("hello "), 0), hunk(nil, 0)...)
+	in = append(in, hunk([]byte("world"), 0)...)
+	conn = newGunConn(bytes.NewReader(in), io.Discard, io.NopCloser(nil), nil, nil)
+	defer conn.Close()
+	var got bytes.Buffer
+	if n, err := conn.WriteTo(&got); err != nil || n != 11 || got.String() != "hello world" {
+		t.Fatalf("WriteTo = %v, %v, %q", n, err, got.String())
+	}
+}
+
+func TestMaxWriteSize(t *testing.T) {
+	var out bytes.Buffer
+	conn := newGunConn(bytes.NewReader(nil), &out, io.NopCloser(nil), nil, nil)
+	defer conn.Close()
+	conn.maxWriteSize = 4
+	if n, err := conn.Write([]byte("helloworld")); n != 10 || err != nil {
+		t.Fatalf("Write = %v, %v", n, err)
+	}
+	want := append(hunk([]byte("hell"), 0), hunk([]byte("owor"), 0)...)
+	want = append(want, hunk([]byte("ld"), 0)...)
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Fatalf("wrote %x, want %x", out.Bytes(), want)
+	}
+	out.Reset()
+	if n, err := conn.ReadFrom(bytes.NewReader([]byte("hello"))); n != 5 || err != nil {
+		t.Fatalf("ReadFrom = %v, %v", n, err)
+	}
+	if want := append(hunk([]byte("hell"), 0), hunk([]byte("o"), 0)...); !bytes.Equal(out.Bytes(), want) {
+		t.Fatalf("wrote %x, want %x", out.Bytes(), want)
+	}
+}
+
+func TestHandlerMulti(t *testing.T) {
+	handler := NewHandler(&ServerConfig{}, func(conn net.Conn) {
+		buf := make([]byte, 10)
+		if _, err := io.ReadFull(conn, buf); err == nil {
+			_, _ = conn.Write(buf)
+		}
+	})
+
+	// a MultiHunk of two payloads
+	message := append([]byte{0x0A, 5}, "hello"...)
+	message = append(message, 0x0A, 5)
+	message = append(message, "world"...)
+	body := append([]byte{0, 0, 0, 0, byte(len(message))}, message...)
+	request := httptest.NewRequest(http.MethodPost, "/GunService/TunMulti", bytes.NewReader(body))
+	request.Header.Set("content-type", "application/grpc")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	response := recorder.Result()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", response.StatusCode)
+	}
+	if b, _ := io.ReadAll(response.Body); !bytes.Equal(b, hunk([]byte("helloworld"), 0)) {
+		t.Fatalf("response body %x", b)
+	}
+
+	cli := NewGunClient(&Config{RemoteAddr: "example.com:443", Mode: ModeMulti})
+	defer cli.Close()
+	if path := cli.streamURL().Path; path != "/GunService/TunMulti" {
+		t.Fatalf("path %q", path)
+	}
+}
+
+// handlerTransport serves the requests of a Client with h in process,
+// streaming the response body as the HTTP/2 transport does.
+type handlerTransport struct {
+	h http.Handler
+}
+
+func (t handlerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// canonicalize the lowercase headers, as the HTTP/2 server does
+	header := make(http.Header)
+	for k, v := range r.Header {
+		header[http.CanonicalHeaderKey(k)] = v
+	}
+	r = r.Clone(r.Context())
+	r.Header = header
+	body, bodyWriter := io.Pipe()
+	w := &pipeResponseWriter{header: make(http.Header), w: bodyWriter, body: body, response: make(chan *http.Response, 1)}
+	go func() {
+		t.h.ServeHTTP(w, r)
+		w.WriteHeader(http.StatusOK)
+		_ = bodyWriter.Close()
+	}()
+	select {
+	case response := <-w.response:
+		return response, nil
+	case <-r.Context().Done():
+		return nil, r.Context().Err()
+	}
+}
+
+// pipeResponseWriter is the http.ResponseWriter of handlerTransport.
+type pipeResponseWriter struct {
+	header      http.Header
+	w           *io.PipeWriter
+	body        io.ReadCloser
+	response    chan *http.Response
+	wroteHeader bool
+}
+
+func (w *pipeResponseWriter) Header() http.Header { return w.header }
+
+func (w *pipeResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.response <- &http.Response{
+		Status:     http.StatusText(status),
+		StatusCode: status,
+		Proto:      "HTTP/2",
+		ProtoMajor: 2,
+		Header:     w.header.Clone(),
+		Body:       w.body,
+	}
+}
+
+func (w *pipeResponseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.w.Write(b)
+}
+
+func (w *pipeResponseWriter) Flush() {}
+
+// echoClient returns a Client of config whose streams are echoed by a Handler
+// of serverConfig.
+func echoClient(config *Config, serverConfig *ServerConfig) *Client {
+	handler := NewHandler(serverConfig, func(conn net.Conn) {
+		_, _ = io.Copy(conn, conn)
+	})
+	cli := NewGunClient(config)
+	cli.client.Transport = handlerTransport{handler}
+	return cli
+}
+
+// checkCopyEcho copies data to conn and reads it back, both with io.Copy.
+func checkCopyEcho(t *testing.T, conn net.Conn) {
+	data := bytes.Repeat([]byte("compressible gun data "), 10000)
+	go func() {
+		_, _ = io.Copy(conn, struct{ io.Reader }{bytes.NewReader(data)})
+		_ = conn.(interface{ CloseWrite() error }).CloseWrite()
+	}()
+	var got bytes.Buffer
+	if _, err := io.Copy(&got, conn); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), data) {
+		t.Fatalf("echoed %d bytes, want %d", got.Len(), len(data))
+	}
+}
+
+func TestCompressedCopy(t *testing.T) {
+	for _, compression := range []Compression{CompressionLZ4, CompressionDeflate} {
+		cli := echoClient(&Config{RemoteAddr: "example.com:443", Compression: compression}, &ServerConfig{Compression: true})
+		conn, err := cli.DialConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := conn.(*compressedConn); !ok {
+			t.Fatalf("dialed %T", conn)
+		}
+		checkCopyEcho(t, conn)
+		conn.Close()
+		cli.Close()
+	}
+}
+
+func TestDialedReadFrom(t *testing.T) {
+	cli := echoClient(&Config{RemoteAddr: "example.com:443"}, &ServerConfig{})
+	defer cli.Close()
+	conn, err := cli.dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if !conn.writesInPlace() {
+		t.Fatal("dialed interactive stream does not write in place")
+	}
+	conn.SetPriority(PriorityBulk)
+	if conn.writesInPlace() {
+		t.Fatal("bulk stream writes in place")
+	}
+	conn.SetPriority(PriorityInteractive)
+	checkCopyEcho(t, conn)
+}
+
+// overlapWriter fails the test if two writes overlap.
+type overlapWriter struct {
+	t    *testing.T
+	busy int32
+}
+
+func (w *overlapWriter) Write(b []byte) (int, error) {
+	if !atomic.CompareAndSwapInt32(&w.busy, 0, 1) {
+		w.t.Error("overlapping writes")
+		return len(b), nil
+	}
+	time.Sleep(10 * time.Microsecond)
+	atomic.StoreInt32(&w.busy, 0)
+	return len(b), nil
+}
+
+func TestTryWriteWithWrite(t *testing.T) {
+	conn := newGunConn(bytes.NewReader(nil), &overlapWriter{t: t}, io.NopCloser(nil), nil, nil)
+	defer conn.Close()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			if _, err := conn.Write([]byte("aaaa")); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; {
+			_, err := conn.TryWrite([]byte("bbbb"))
+			switch err {
+			case nil:
+				i++
+			case ErrWouldBlock:
+				<-conn.Writable()
+			default:
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	if err := conn.waitPending(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentDials(t *testing.T) {
+	cli := NewGunClient(&Config{RemoteAddr: "example.com:443"})
+	defer cli.Close()
+	hung := make(chan struct{})
+	dialing := make(chan struct{})
+	cli.pool.dial = func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+		if addr == "example.com:443" {
+			close(dialing)
+			<-hung
+		}
+		return nil, errors.New("unreachable")
+	}
+	first := make(chan error, 1)
+	go func() {
+		_, err := cli.pool.getConn(context.Background(), "example.com:443", nil, nil)
+		first <- err
+	}()
+	<-dialing
+
+	// streams to the hung address give up with their context
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := cli.pool.getConn(ctx, "example.com:443", nil, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("waiting for the hung dial: %v", err)
+	}
+	// and other addresses are dialed meanwhile
+	if _, err := cli.pool.getConn(context.Background(), "other.example:443", nil, nil); err == nil || errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("dialing another address: %v", err)
+	}
+	close(hung)
+	if err := <-first; err == nil {
+		t.Fatal("hung dial succeeded")
+	}
+}
+
+func TestProfilePerConn(t *testing.T) {
+	cli := NewGunClient(&Config{RemoteAddr: "example.com:443", HeaderProfiles: HeaderProfiles, Compression: CompressionDeflate})
+	if p := cli.pool.pickProfile(); p == nil || LookupHeaderProfile(p.Name) == nil {
+		t.Fatalf("picked profile %v", p)
+	}
+	cli.pool.conns["example.com:443"] = []*pooledConn{{cc: new(http2.ClientConn), profile: ProfileGrpcJava}}
+	for i := 0; i < 5; i++ {
+		request := &http.Request{Method: http.MethodPost, URL: cli.streamURL(), Header: cli.requestHeader()}
+		slot := new(streamSlot)
+		request = request.WithContext(withProfileHeader(withStreamSlot(context.Background(), slot), cli.streamHeader))
+		profile, err := cli.pool.reserve(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if profile != ProfileGrpcJava {
+			t.Fatalf("reserved profile %v", profile)
+		}
+		header := cli.streamHeader(profile)
+		if ua := header["user-agent"]; len(ua) != 1 || ua[0] != ProfileGrpcJava.Header["user-agent"][0] {
+			t.Fatalf("user-agent %q", ua)
+		}
+		if header[compressionHeader] == nil {
+			t.Fatal("compression header dropped")
+		}
+		header["user-agent"] = []string{"changed"}
+		if ProfileGrpcJava.Header["user-agent"][0] == "changed" {
+			t.Fatal("profile headers shared with a request")
+		}
+		before := request.Header.Clone()
+		cc, err := cli.pool.GetClientConn(request, "example.com:443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cc != slot.pc.cc || !reflect.DeepEqual(request.Header, before) {
+			t.Fatal("transport did not get the reserved connection untouched")
+		}
+		cli.pool.release(slot)
+	}
+}
+
+func TestBulkStalledInteractive(t *testing.T) {
+	var qos qosScheduler
+	// an interactive write stalled on flow control behind another bulk write
+	qos.beginBulk()
+	defer qos.endBulk()
+	qos.beginInteractive()
+	defer qos.endInteractive()
+
+	conn := newGunConn(bytes.NewReader(nil), io.Discard, io.NopCloser(nil), nil, nil)
+	defer conn.Close()
+	conn.qos = &qos
+	conn.SetPriority(PriorityBulk)
+	payload := make([]byte, bulkMaxHunkSize)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if _, err := conn.Write(payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d >= 3*bulkMaxYield {
+		t.Fatalf("10 bulk hunks took %v behind a stalled interactive write", d)
+	}
+}
+
+// nonZero returns a value of t differing from its zero value.
+func nonZero(t *testing.T, typ reflect.Type) reflect.Value {
+	v := reflect.New(typ).Elem()
+	switch typ.Kind() {
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		v.SetInt(12345)
+	case reflect.Uint8:
+		v.SetUint(42)
+	case reflect.String:
+		v.SetString("x")
+	case reflect.Slice:
+		v = reflect.Append(v, nonZero(t, typ.Elem()))
+	case reflect.Map:
+		v = reflect.MakeMap(typ)
+		v.SetMapIndex(nonZero(t, typ.Key()), nonZero(t, typ.Elem()))
+	case reflect.Ptr:
+		v = reflect.New(typ.Elem())
+	case reflect.Struct:
+		v.Field(0).Set(nonZero(t, typ.Field(0).Type))
+	case reflect.Func:
+		v = reflect.MakeFunc(typ, func([]reflect.Value) []reflect.Value { return nil })
+	case reflect.Interface:
+		if typ != reflect.TypeOf((*tls.ClientSessionCache)(nil)).Elem() {
+			t.Fatalf("no value for %v", typ)
+		}
+		v.Set(reflect.ValueOf(tls.NewLRUClientSessionCache(1)))
+	default:
+		t.Fatalf("no value for %v", typ)
+	}
+	return v
+}
+
+func TestConfigKeyFields(t *testing.T) {
+	// the fields only counting together with these are set
+	base := Config{
+		RetryStatuses:    []int{503},
+		KeepWarmInterval: time.Second,
+		ReuseCheckAfter:  time.Second,
+		ReadIdleTimeout:  time.Second,
+	}
+	baseKey, ok := configKey(&base)
+	if !ok {
+		t.Fatal("base config not comparable")
+	}
+	typ := reflect.TypeOf(base)
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		config := base
+		reflect.ValueOf(&config).Elem().Field(i).Set(nonZero(t, field.Type))
+		key, ok := configKey(&config)
+		if field.Type.Kind() == reflect.Func || field.Type.Kind() == reflect.Slice && field.Type.Elem().Kind() == reflect.Func {
+			if ok {
+				t.Errorf("config with %s is comparable", field.Name)
+			}
+			continue
+		}
+		if !ok || key == baseKey {
+			t.Errorf("%s is not part of the config key", field.Name)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package realgun
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// readFromSize is the data size of the hunks ReadFrom sends, the buffer size
+// of io.Copy, unless the stream bounds hunks to less.
+const readFromSize = 32 << 10
+
+// ReadFrom implements io.ReaderFrom, reading from r straight into the buffer
+// of the next hunk behind room for its header, so relaying r needs no staging
+// copy. Data of streams splitting or timing their writes goes through Write.
+func (g *GunConn) ReadFrom(r io.Reader) (n int64, err error) {
+	buf := getHunkBuffer()
+	b := *buf
+	if cap(b) < maxHunkHeaderSize+readFromSize {
+		b = make([]byte, 0, maxHunkHeaderSize+readFromSize)
+	}
+	size := readFromSize
+	if g.maxWriteSize > 0 && g.maxWriteSize < size {
+		size = g.maxWriteSize
+	}
+	b = b[:maxHunkHeaderSize+size]
+	defer putHunkBuffer(buf, b)
+	for {
+		m, rerr := r.Read(b[maxHunkHeaderSize:])
+		if m > 0 {
+			if g.writesInPlace() {
+				err = g.writeInPlace(b, m)
+			} else {
+				_, err = g.Write(b[maxHunkHeaderSize : maxHunkHeaderSize+m])
+			}
+			if err != nil {
+				return n, err
+			}
+			n += int64(m)
+		}
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+// writesInPlace reports whether a write can go out as a single hunk without
+// further scheduling, as writeInPlace sends it.
+func (g *GunConn) writesInPlace() bool {
+	return !g.writeDeadline.active() && g.firstFlight <= 0 && g.sizer == nil &&
+		(g.qos == nil || g.Priority() != PriorityBulk)
+}
+
+// writeInPlace sends the m bytes of data in b after maxHunkHeaderSize bytes
+// of room for the header as one hunk.
+func (g *GunConn) writeInPlace(b []byte, m int) error {
+	p, err := g.claimWrite(nil)
+	if err != nil {
+		return err
+	}
+	defer g.releaseWrite(p)
+	if g.isClosed() || atomic.LoadInt32(&g.writeClosed) != 0 {
+		return ErrClosed
+	}
+	if g.qos != nil && g.qos.beginInteractive() {
+		defer g.qos.endInteractive()
+	}
+	// move the header up against the data
+	header := appendHunkHeader(b[:0], m)
+	start := maxHunkHeaderSize - len(header)
+	copy(b[start:], header)
+	_, err = g.writer.Write(b[start : maxHunkHeaderSize+m])
+	if f, ok := g.writer.(http.Flusher); ok {
+		f.Flush()
+	}
+	if err != nil {
+		if g.isClosed() {
+			err = ErrClosed
+		}
+		return err
+	}
+	atomic.AddInt64(&g.bytesWritten, int64(m))
+	g.throttle(g.writeLimit, m)
+	return nil
+}
+
+// WriteTo implements io.WriterTo, writing the data of every message straight
+// to w instead of through a caller's buffer. It returns at EOF. Reads with a
+// read deadline fall back to Read.
+func (g *GunConn) WriteTo(w io.Writer) (n int64, err error) {
+	if g.sniffing != nil {
+		<-g.sniffing
+	}
+	for !g.readsTimed() {
+		var data []byte
+		if g.toRead != nil {
+			data = g.toRead[g.readAt:]
+			g.toRead = nil
+		} else {
+			if g.buffered != nil {
+				if err = g.syncToHunk(false); err != nil {
+					return n, g.readError(err)
+				}
+			}
+			if data, err = g.readHunk(); err != nil {
+				g.releaseHeld()
+				if err == io.EOF {
+					return n, nil
+				}
+				return n, g.readError(err)
+			}
+		}
+		m, err := w.Write(data)
+		g.releaseHeld()
+		n += int64(m)
+		atomic.AddInt64(&g.bytesRead, int64(m))
+		g.throttle(g.readLimit, m)
+		if err == nil && m < len(data) {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	m, err := io.Copy(w, struct{ io.Reader }{g})
+	return n + m, err
+}
+
+// readError is err as returned by Read.
+func (g *GunConn) readError(err error) error {
+	if err != io.EOF && g.isClosed() {
+		return ErrClosed
+	}
+	return err
+}
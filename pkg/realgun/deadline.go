@@ -0,0 +1,154 @@
+package realgun
+
+import (
+	"sync"
+	"time"
+)
+
+// deadline is a read or write deadline of a GunConn. While one is set, the
+// operations go through a background path, so that changing the deadline
+// interrupts the ones already blocked.
+type deadline struct {
+	mu sync.Mutex
+	t  time.Time
+	// changed is closed and replaced whenever t changes, nil until set
+	changed chan struct{}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.t = t
+	if d.changed != nil {
+		close(d.changed)
+	}
+	d.changed = make(chan struct{})
+}
+
+// active reports whether the deadline is set.
+func (d *deadline) active() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return !d.t.IsZero()
+}
+
+// expired reports whether the deadline is exceeded.
+func (d *deadline) expired() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return !d.t.IsZero() && !time.Now().Before(d.t)
+}
+
+// wait blocks until ch is closed, or fails with ErrTimeout once the deadline,
+// as it may change meanwhile, is exceeded.
+func (d *deadline) wait(ch <-chan struct{}) error {
+	for {
+		d.mu.Lock()
+		t, changed := d.t, d.changed
+		d.mu.Unlock()
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !t.IsZero() {
+			remaining := time.Until(t)
+			if remaining <= 0 {
+				return ErrTimeout
+			}
+			timer = time.NewTimer(remaining)
+			timeout = timer.C
+		}
+		select {
+		case <-ch:
+		case <-timeout:
+			return ErrTimeout
+		case <-changed:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		select {
+		case <-ch:
+			return nil
+		default:
+		}
+	}
+}
+
+// writeTimed writes b in the background and waits for it until the write
+// deadline. A write still in flight at the deadline stays queued, like data
+// in a socket buffer, and is reported as written; the next one times out
+// waiting for it.
+func (g *GunConn) writeTimed(b []byte) (int, error) {
+	p, err := g.claimWrite(g.writeDeadline.wait)
+	if err != nil {
+		return 0, err
+	}
+	if g.writeDeadline.expired() {
+		g.releaseWrite(p)
+		return 0, ErrTimeout
+	}
+	g.startWrite(p, b)
+	if err := g.writeDeadline.wait(p.done); err != nil {
+		return len(b), nil
+	}
+	if err := g.collectWrite(p); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// readsTimed reports whether reads go through readTimed: while a read
+// deadline is set, or a read timed out before is still running.
+func (g *GunConn) readsTimed() bool {
+	if g.readDeadline.active() {
+		return true
+	}
+	g.rmu.Lock()
+	defer g.rmu.Unlock()
+	return g.readPending != nil
+}
+
+// pendingRead is a read running in the background for readTimed.
+type pendingRead struct {
+	done chan struct{}
+	// buf and err are the result, set before done is closed
+	buf []byte
+	err error
+}
+
+// readTimed reads into b, waiting until the read deadline. A read timing out
+// continues in the background, and the next Read returns its data.
+func (g *GunConn) readTimed(b []byte) (int, error) {
+	g.rmu.Lock()
+	p := g.readPending
+	if p == nil {
+		if g.toRead != nil {
+			// buffered data needs no waiting
+			g.rmu.Unlock()
+			return g.read(b)
+		}
+		p = &pendingRead{done: make(chan struct{}), buf: make([]byte, len(b))}
+		g.readPending = p
+		go func() {
+			n, err := g.read(p.buf)
+			p.buf, p.err = p.buf[:n], err
+			close(p.done)
+		}()
+	}
+	g.rmu.Unlock()
+
+	if err := g.readDeadline.wait(p.done); err != nil {
+		return 0, err
+	}
+	g.rmu.Lock()
+	defer g.rmu.Unlock()
+	n := copy(b, p.buf)
+	p.buf = p.buf[n:]
+	if len(p.buf) > 0 {
+		return n, nil
+	}
+	g.readPending = nil
+	if n > 0 {
+		return n, nil
+	}
+	return 0, p.err
+}
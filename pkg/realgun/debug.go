@@ -0,0 +1,30 @@
+package realgun
+
+import (
+	"io"
+	"net"
+)
+
+// debugServe returns the serve function of the debug service requestPath
+// addresses, see ServerConfig.DebugServices, or nil.
+func (h *Handler) debugServe(requestPath string) func(g *GunConn, conn net.Conn) {
+	switch {
+	case !h.config.DebugServices:
+		return nil
+	case MatchPath("/"+h.serviceName+"/Echo", requestPath):
+		return serveEcho
+	case MatchPath("/"+h.serviceName+"/Discard", requestPath):
+		return serveDiscard
+	}
+	return nil
+}
+
+// serveEcho sends back all data of the stream.
+func serveEcho(g *GunConn, conn net.Conn) {
+	_, _ = io.Copy(conn, conn)
+}
+
+// serveDiscard reads the stream to its end, sending nothing.
+func serveDiscard(g *GunConn, conn net.Conn) {
+	_, _ = io.Copy(io.Discard, conn)
+}
@@ -0,0 +1,78 @@
+package realgun
+
+import (
+	"fmt"
+
+	"ekyu.moe/leb128"
+)
+
+// Protobuf wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// hunkDataField is the field number of the data of the Hunk message.
+const hunkDataField = 1
+
+// errMalformed describes a message decodeHunk refuses. It matches
+// ErrInvalidLength with errors.Is.
+func errMalformed(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: "+format, append([]interface{}{ErrInvalidLength}, args...)...)
+}
+
+// decodeHunk returns the data of the protobuf Hunk message msg. Fields other
+// than the data are skipped, and repeated data fields are concatenated. With
+// lenient, trailing bytes that do not parse as a field, e.g. padding, and a
+// last field overrunning msg are tolerated; lenient reports whether that was
+// necessary.
+func decodeHunk(msg []byte, lenient bool) (data []byte, tolerated bool, err error) {
+	fields := 0
+	for len(msg) > 0 {
+		tag, n := leb128.DecodeUleb128(msg)
+		field, wireType := tag>>3, tag&7
+		if n == 0 || field == 0 || wireType != wireVarint && wireType != wireFixed64 && wireType != wireBytes && wireType != wireFixed32 {
+			if lenient && fields > 0 {
+				return data, true, nil
+			}
+			return nil, false, errMalformed("bad protobuf tag %#x", tag)
+		}
+		msg = msg[n:]
+		fields++
+
+		var size uint64
+		switch wireType {
+		case wireVarint:
+			if _, n = leb128.DecodeUleb128(msg); n == 0 {
+				return nil, false, errMalformed("truncated varint of field %d", field)
+			}
+			size = uint64(n)
+		case wireFixed64:
+			size = 8
+		case wireFixed32:
+			size = 4
+		case wireBytes:
+			if size, n = leb128.DecodeUleb128(msg); n == 0 {
+				return nil, false, errMalformed("truncated length of field %d", field)
+			}
+			msg = msg[n:]
+		}
+		if size > uint64(len(msg)) {
+			if !lenient || wireType != wireBytes {
+				return nil, false, errMalformed("field %d of %d bytes overruns the message by %d bytes", field, size, size-uint64(len(msg)))
+			}
+			size, tolerated = uint64(len(msg)), true
+		}
+		if wireType == wireBytes && field == hunkDataField {
+			if data == nil {
+				data = msg[:size:size]
+			} else {
+				data = append(data, msg[:size]...)
+			}
+		}
+		msg = msg[size:]
+	}
+	return data, tolerated, nil
+}
@@ -0,0 +1,142 @@
+package realgun
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// NewDoHResolver returns a resolver sending its DNS queries to the
+// DNS-over-HTTPS server at url, e.g. https://1.1.1.1/dns-query, through
+// client, http.DefaultClient if nil. Set it as Config.Resolver to keep the
+// lookups of the server address away from poisoned plaintext DNS. The host
+// of url should be an IP address, as looking it up goes to the system
+// resolver.
+//
+// The resolver relies on the pure Go resolver. Platforms without it, such as
+// Windows with older Go releases, keep resolving through the system.
+func NewDoHResolver(url string, client *http.Client) *net.Resolver {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return &dohConn{ctx: ctx, url: url, client: client}, nil
+		},
+	}
+}
+
+// dohConn is the connection to a DNS server the Go resolver believes to
+// talk to. Every query written is answered by a DoH request. Not being a
+// net.PacketConn, it gets messages framed by their length as in DNS over TCP.
+type dohConn struct {
+	ctx    context.Context
+	url    string
+	client *http.Client
+
+	mu       sync.Mutex
+	query    bytes.Buffer
+	response bytes.Reader
+	deadline time.Time
+}
+
+// maxDNSMessage is the size limit of DNS messages.
+const maxDNSMessage = 65535
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.query.Write(b)
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.response.Len() == 0 {
+		if err := c.exchange(); err != nil {
+			return 0, err
+		}
+	}
+	return c.response.Read(b)
+}
+
+// exchange sends the buffered query and buffers the response. c.mu must be
+// held.
+func (c *dohConn) exchange() error {
+	query := c.query.Bytes()
+	if len(query) < 2 || len(query) < 2+int(binary.BigEndian.Uint16(query)) {
+		return io.ErrUnexpectedEOF
+	}
+	query = query[2 : 2+binary.BigEndian.Uint16(query)]
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(query))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("content-type", "application/dns-message")
+	request.Header.Set("accept", "application/dns-message")
+	response, err := c.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("realgun: unexpected DoH response status %s", response.Status)
+	}
+	answer, err := io.ReadAll(io.LimitReader(response.Body, maxDNSMessage+1))
+	if err != nil {
+		return err
+	}
+	if len(answer) > maxDNSMessage {
+		return errors.New("realgun: DoH response too large")
+	}
+	answer = append([]byte{byte(len(answer) >> 8), byte(len(answer))}, answer...)
+	c.query.Reset()
+	c.response.Reset(answer)
+	return nil
+}
+
+func (c *dohConn) Close() error {
+	return nil
+}
+
+func (c *dohConn) LocalAddr() net.Addr {
+	return dohAddr(c.url)
+}
+
+func (c *dohConn) RemoteAddr() net.Addr {
+	return dohAddr(c.url)
+}
+
+func (c *dohConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *dohConn) SetReadDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+
+func (c *dohConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type dohAddr string
+
+func (a dohAddr) Network() string { return "doh" }
+func (a dohAddr) String() string  { return string(a) }
@@ -0,0 +1,45 @@
+package realgun
+
+import (
+	"io"
+	"time"
+)
+
+// drain performs the orderly part of Close: it waits for a pending TryWrite,
+// ends the request body and waits for the response to finish, discarding
+// unread data, all until deadline.
+func (g *GunConn) drain(deadline time.Time) {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	flushed := make(chan struct{})
+	go func() {
+		_ = g.waitPending()
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+	case <-timer.C:
+		return
+	}
+
+	if w, ok := g.writer.(io.Closer); ok {
+		_ = w.Close()
+	}
+	go func() {
+		_, _ = io.Copy(io.Discard, g.reader)
+	}()
+	select {
+	case <-g.ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// closeDraining closes the stream like Close, draining it until deadline
+// instead of for its own drainTimeout.
+func (g *GunConn) closeDraining(deadline time.Time) error {
+	if g.drainTimeout > 0 && !g.isClosed() {
+		g.drain(deadline)
+	}
+	return g.close()
+}
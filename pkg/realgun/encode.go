@@ -0,0 +1,78 @@
+package realgun
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+
+	"ekyu.moe/leb128"
+)
+
+// maxHunkHeaderSize is the size of the gRPC header, the data field tag and
+// the longest uleb128 length.
+const maxHunkHeaderSize = 5 + 1 + 10
+
+// maxPooledHunkSize bounds the buffers kept in hunkBuffers, so a single huge
+// write does not pin its buffer.
+const maxPooledHunkSize = 256 << 10
+
+// defaultMaxWriteSize is the default of Config.MaxWriteSize.
+const defaultMaxWriteSize = 64 << 10
+
+func maxWriteSize(size int) int {
+	if size == 0 {
+		return defaultMaxWriteSize
+	}
+	if size < 0 {
+		return 0
+	}
+	return size
+}
+
+// hunkBuffers holds scratch buffers for encoding hunks.
+var hunkBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 32<<10)
+		return &b
+	},
+}
+
+// appendHunkHeader appends the headers of a hunk carrying size bytes of data
+// to dst.
+func appendHunkHeader(dst []byte, size int) []byte {
+	start := len(dst)
+	dst = append(dst, 0, 0, 0, 0, 0, 0x0A)
+	dst = leb128.AppendUleb128(dst, uint64(size))
+	binary.BigEndian.PutUint32(dst[start+1:], uint32(len(dst)-start-5+size))
+	return dst
+}
+
+// writeVectored writes header and data with a single writev if w is a socket
+// supporting it, saving the copy into a scratch buffer. It reports whether w
+// was such a socket.
+func writeVectored(w io.Writer, header, data []byte) (bool, error) {
+	switch w := w.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		bufs := net.Buffers{header, data}
+		_, err := bufs.WriteTo(w)
+		return true, err
+	case *serverWriter:
+		return w.writeVectored(header, data)
+	}
+	return false, nil
+}
+
+// getHunkBuffer returns a scratch buffer from hunkBuffers.
+func getHunkBuffer() *[]byte {
+	return hunkBuffers.Get().(*[]byte)
+}
+
+// putHunkBuffer returns buf, last grown to b, to hunkBuffers.
+func putHunkBuffer(buf *[]byte, b []byte) {
+	if cap(b) > maxPooledHunkSize {
+		return
+	}
+	*buf = b[:0]
+	hunkBuffers.Put(buf)
+}
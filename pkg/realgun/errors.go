@@ -0,0 +1,119 @@
+package realgun
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// maxHunkSize bounds the gRPC message length of received hunks, so peers
+// cannot make a stream allocate gigabytes.
+const maxHunkSize = 1 << 24
+
+var (
+	ErrInvalidLength = errors.New("realgun: invalid length")
+	// ErrFrameTooLarge is returned by Read when the peer sends a hunk longer
+	// than 16MB.
+	ErrFrameTooLarge = errors.New("realgun: frame too large")
+	// ErrDialFailed wraps the errors of connecting to the server, including
+	// resolving its address and going through proxies.
+	ErrDialFailed error = &netError{msg: "realgun: dial failed", temporary: true}
+	// ErrHandshake wraps the errors of the TLS and HTTP/2 handshakes with the
+	// server, e.g. certificates failing verification.
+	ErrHandshake error = &netError{msg: "realgun: handshake failed"}
+	// ErrClosed is returned by operations on a closed GunConn. It matches
+	// net.ErrClosed with errors.Is.
+	ErrClosed error = &netError{msg: "realgun: use of closed gun connection", err: net.ErrClosed}
+	// ErrTimeout is returned when a deadline is exceeded. It is a net.Error
+	// with Timeout() true and matches os.ErrDeadlineExceeded with errors.Is.
+	ErrTimeout error = &netError{msg: "realgun: i/o timeout", timeout: true, temporary: true, err: os.ErrDeadlineExceeded}
+	// ErrWouldBlock is returned by TryWrite while an earlier write is still
+	// in flight. It is a temporary net.Error.
+	ErrWouldBlock error = &netError{msg: "realgun: write would block", temporary: true}
+	// ErrOverLimit is returned when a stream would exceed the configured
+	// Limits. It is a temporary net.Error.
+	ErrOverLimit error = &netError{msg: "realgun: resource limit reached", temporary: true}
+)
+
+var errCloseWriteUnsupported = errors.New("realgun: accepted streams cannot close writing")
+
+// StatusError is returned by the Read and Write of a dialed stream the server
+// refused, with a response status other than 200 or, in a trailers-only
+// response, a grpc-status other than OK. It tells e.g. failed authentication,
+// wrong paths and errors of proxies in between apart.
+type StatusError struct {
+	// StatusCode and Status are those of the HTTP response, e.g. 404 and
+	// "404 Not Found".
+	StatusCode int
+	Status     string
+	// GrpcStatus is the grpc-status of the response, -1 if it has none, and
+	// GrpcMessage its decoded grpc-message.
+	GrpcStatus  int
+	GrpcMessage string
+	// Header holds the response headers.
+	Header http.Header
+}
+
+func (e *StatusError) Error() string {
+	msg := "realgun: unexpected response status " + e.Status
+	if e.StatusCode == http.StatusOK {
+		msg = fmt.Sprintf("realgun: unexpected grpc-status %d", e.GrpcStatus)
+	}
+	if e.GrpcMessage != "" {
+		msg += ": " + e.GrpcMessage
+	}
+	return msg
+}
+
+// statusError returns the StatusError of response, or nil if the server
+// accepted the stream.
+func statusError(response *http.Response) error {
+	e := &StatusError{
+		StatusCode: response.StatusCode,
+		Status:     response.Status,
+		GrpcStatus: -1,
+		Header:     response.Header,
+	}
+	if reason := trailerReason(response.Header); reason != nil {
+		e.GrpcStatus, e.GrpcMessage = int(reason.Code), reason.Message
+	}
+	if e.StatusCode == http.StatusOK && e.GrpcStatus <= 0 {
+		return nil
+	}
+	return e
+}
+
+// wrappedError is err classified as kind. It matches kind with errors.Is and
+// unwraps to err, so errors.As still finds the cause.
+type wrappedError struct {
+	kind error
+	err  error
+}
+
+// Error prefixes the message like the other errors of the package, dropping
+// the prefix of the kind and of causes from this package.
+func (e *wrappedError) Error() string {
+	return "realgun: " + strings.TrimPrefix(e.kind.Error(), "realgun: ") + ": " + strings.TrimPrefix(e.err.Error(), "realgun: ")
+}
+
+func (e *wrappedError) Is(target error) bool { return target == e.kind }
+func (e *wrappedError) Unwrap() error        { return e.err }
+
+// netError is a sentinel error implementing net.Error.
+type netError struct {
+	msg       string
+	timeout   bool
+	temporary bool
+	// err is the standard library error this one stands for, if any
+	err error
+}
+
+var _ net.Error = (*netError)(nil)
+
+func (e *netError) Error() string   { return e.msg }
+func (e *netError) Timeout() bool   { return e.timeout }
+func (e *netError) Temporary() bool { return e.temporary }
+func (e *netError) Unwrap() error   { return e.err }
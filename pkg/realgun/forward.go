@@ -0,0 +1,47 @@
+package realgun
+
+import (
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+const forwardDialTimeout = 10 * time.Second
+
+// forwardTarget returns the network and address of a ServerConfig.ForwardTo
+// target, a unix socket if it starts with "unix:".
+func forwardTarget(target string) (network, addr string) {
+	if strings.HasPrefix(target, "unix:") {
+		return "unix", strings.TrimPrefix(target, "unix:")
+	}
+	return "tcp", target
+}
+
+// forward returns a serve function relaying every stream to the backend at
+// target until either side ends it.
+func forward(target string) func(g *GunConn, conn net.Conn) {
+	network, addr := forwardTarget(target)
+	dialer := &net.Dialer{Timeout: forwardDialTimeout}
+	return func(g *GunConn, conn net.Conn) {
+		backend, err := dialer.DialContext(g.ctx, network, addr)
+		if err != nil {
+			log.Printf("realgun: %v: forwarding: %v", g, err)
+			g.setCloseReason(&CloseReason{Code: grpcUnavailable, Message: "backend unavailable"})
+			return
+		}
+		defer backend.Close()
+		uploaded := make(chan struct{})
+		go func() {
+			defer close(uploaded)
+			_, _ = io.Copy(backend, conn)
+			if cw, ok := backend.(interface{ CloseWrite() error }); ok {
+				_ = cw.CloseWrite()
+			}
+		}()
+		_, _ = io.Copy(conn, backend)
+		_ = conn.Close()
+		<-uploaded
+	}
+}
@@ -0,0 +1,277 @@
+package realgun
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"runtime/pprof"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Handler is an http.Handler serving gun streams, for mounting on an
+// existing HTTP/2 server next to other applications. It recognizes requests
+// for the Tun and TunMulti methods of the configured service and responds 404
+// to others.
+type Handler struct {
+	// activeStreams is the number of streams being served, accessed
+	// atomically
+	activeStreams int64
+
+	config      ServerConfig
+	serviceName string
+	path        string
+	serve       func(g *GunConn, conn net.Conn)
+	// multiPath is the path of TunMulti, empty with a custom path
+	multiPath string
+	// ipStreams and userStreams, if set, limit the rate of new streams
+	ipStreams   *keyedBuckets
+	userStreams *keyedBuckets
+	// bandwidth holds the limiters of users with streams, see
+	// acquireBandwidth
+	bandwidthMu sync.Mutex
+	bandwidth   map[string]*userBandwidth
+}
+
+// NewHandler returns a Handler calling serve with every gun stream, unless
+// config sets ForwardTo. The stream ends when serve returns. The Server fields of config, such as
+// TLSConfig, are up to the embedding HTTP/2 server and ignored.
+func NewHandler(config *ServerConfig, serve func(conn net.Conn)) *Handler {
+	return newHandler(config, func(g *GunConn, conn net.Conn) {
+		serve(conn)
+	})
+}
+
+func newHandler(config *ServerConfig, serve func(g *GunConn, conn net.Conn)) *Handler {
+	var serviceName = "GunService"
+	if config.ServiceName != "" {
+		serviceName = config.ServiceName
+	}
+	path, multiPath := ModeTun.methodPath(serviceName), ModeMulti.methodPath(serviceName)
+	if config.Path != "" {
+		path, multiPath = config.Path, ""
+	}
+	if config.ForwardTo != "" {
+		serve = forward(config.ForwardTo)
+	}
+	return &Handler{
+		config:      *config,
+		serviceName: serviceName,
+		path:        path,
+		multiPath:   multiPath,
+		serve:       serve,
+		ipStreams:   newKeyedBuckets(config.IPStreamRate),
+		userStreams: newKeyedBuckets(config.UserStreamRate),
+		bandwidth:   make(map[string]*userBandwidth),
+	}
+}
+
+// ServeHTTP implements http.Handler, serving a single gun stream.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status := h.config.Strictness.refuse(r)
+	serve := h.route(r.URL.Path)
+	if status == http.StatusNotFound || serve == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if status != 0 {
+		w.WriteHeader(status)
+		return
+	}
+	compression, known := requestCompression(r)
+	if !known || compression != CompressionNone && !h.config.Compression {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	if !h.ipStreams.take(requestIP(r)) {
+		reject(w, grpcResourceExhausted, "stream rate limit of the client exceeded")
+		return
+	}
+	identity := peerIdentity(r.TLS)
+	user := identityUser(identity)
+	if h.config.Authenticate != nil {
+		var err error
+		if user, err = h.config.Authenticate(r, identity); err != nil {
+			reject(w, grpcUnauthenticated, err.Error())
+			return
+		}
+	}
+	if user != "" && !h.userStreams.take(user) {
+		reject(w, grpcResourceExhausted, "stream rate limit of the user exceeded")
+		return
+	}
+	if h.config.Admit != nil {
+		info := AdmissionInfo{
+			RemoteAddr:    requestRemoteAddr(r),
+			Path:          r.URL.Path,
+			User:          user,
+			ActiveStreams: int(atomic.LoadInt64(&h.activeStreams)),
+		}
+		if err := h.config.Admit(r.Context(), info); err != nil {
+			reject(w, grpcResourceExhausted, err.Error())
+			return
+		}
+	}
+	if !h.admitStream() {
+		reject(w, grpcResourceExhausted, "server resource limit reached")
+		return
+	}
+	defer atomic.AddInt64(&h.activeStreams, -1)
+	w.Header().Set("content-type", "application/grpc")
+	w.WriteHeader(http.StatusOK)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	sw := &serverWriter{w: w}
+	sw.f, _ = w.(http.Flusher)
+	conn := newServerConn(&h.config, h.serviceName, r, sw, identity, user)
+	if user := conn.User(); user != "" && (h.config.UserUploadRate > 0 || h.config.UserDownloadRate > 0) {
+		bw := h.acquireBandwidth(user)
+		defer h.releaseBandwidth(user)
+		conn.readLimit, conn.writeLimit = bw.upload, bw.download
+	}
+	// closeCancelled closes the stream if the client cancelled it
+	closeCancelled := func() {
+		if r.Context().Err() != nil {
+			conn.setCloseReason(&CloseReason{Code: grpcCanceled, Message: "stream cancelled by peer", Remote: true})
+			_ = conn.Close()
+		}
+	}
+	defer func() {
+		closeCancelled()
+		_ = conn.Close()
+		sw.finish()
+		conn.writeReasonTrailer(w.Header())
+		if h.config.OnStreamEnd != nil {
+			h.config.OnStreamEnd(conn.streamLog(r))
+		}
+	}()
+	go func() {
+		<-conn.ctx.Done()
+		closeCancelled()
+	}()
+
+	pprof.Do(r.Context(), conn.labels, func(context.Context) {
+		if compression != CompressionNone {
+			cc := newCompressedConn(conn, compression)
+			serve(conn, applyMiddlewares(cc, h.config.Middlewares))
+			// end the compressed stream if serve did not close it
+			_ = cc.Close()
+			return
+		}
+		if h.config.Sniffer != nil {
+			conn.sniff(h.config.Sniffer, h.config.SniffTimeout)
+		}
+		serve(conn, applyMiddlewares(conn, h.config.Middlewares))
+	})
+}
+
+// reject refuses a stream with a trailers-only response carrying a gRPC
+// status, as gRPC servers refuse calls.
+func reject(w http.ResponseWriter, code uint32, message string) {
+	w.Header().Set("content-type", "application/grpc")
+	w.Header().Set("grpc-status", strconv.FormatUint(uint64(code), 10))
+	w.Header().Set("grpc-message", encodeGrpcMessage(message))
+	w.WriteHeader(http.StatusOK)
+}
+
+// route returns the serve function of the method requestPath addresses, or
+// nil if it addresses none.
+func (h *Handler) route(requestPath string) func(g *GunConn, conn net.Conn) {
+	if MatchPath(h.path, requestPath) || h.multiPath != "" && MatchPath(h.multiPath, requestPath) {
+		return h.serve
+	}
+	return h.debugServe(requestPath)
+}
+
+// NewServerConn returns the server side of the gun stream of request, for
+// HTTP servers other than the one of net/http. w writes the response body and
+// f, which may be nil, flushes it. The caller must have sent the response
+// headers, and sends the grpc-status trailer once the conn is closed. The
+// calling goroutine is not labeled, see Labels.
+func NewServerConn(config *ServerConfig, request *http.Request, w io.Writer, f http.Flusher) *GunConn {
+	var serviceName = "GunService"
+	if config.ServiceName != "" {
+		serviceName = config.ServiceName
+	}
+	identity := peerIdentity(request.TLS)
+	return newServerConn(config, serviceName, request, &serverWriter{w: w, f: f}, identity, identityUser(identity))
+}
+
+func newServerConn(config *ServerConfig, serviceName string, r *http.Request, sw *serverWriter, identity *PeerIdentity, user string) *GunConn {
+	conn := newGunConn(r.Body, sw, r.Body, requestLocalAddr(r), requestRemoteAddr(r))
+	// the request context is cancelled once the client resets the stream or
+	// the connection drops
+	conn.ctx, conn.cancel = context.WithCancel(r.Context())
+	conn.peerIdentity = identity
+	conn.user = user
+	conn.lenient = config.LenientRead
+	conn.strict = config.Strictness == StrictnessStrict
+	if config.Resync {
+		conn.enableResync()
+	}
+	if config.AdaptiveHunkSize {
+		conn.sizer = newHunkSizer()
+	}
+	if config.OnRate != nil {
+		go conn.reportRates(rateInterval(config.RateInterval), config.OnRate)
+	}
+	conn.labels = pprof.Labels("endpoint", r.RemoteAddr, "service", serviceName, "stream", strconv.FormatUint(conn.id, 10))
+	return conn
+}
+
+// serverWriter guards the response body of a stream against writes after
+// the handler returned, which the HTTP/2 server does not allow.
+type serverWriter struct {
+	mu       sync.Mutex
+	w        io.Writer
+	f        http.Flusher
+	finished bool
+}
+
+func (sw *serverWriter) Write(b []byte) (int, error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if sw.finished {
+		return 0, ErrClosed
+	}
+	return sw.w.Write(b)
+}
+
+func (sw *serverWriter) writeVectored(header, data []byte) (bool, error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if sw.finished {
+		return true, ErrClosed
+	}
+	return writeVectored(sw.w, header, data)
+}
+
+func (sw *serverWriter) Flush() {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if sw.f != nil && !sw.finished {
+		sw.f.Flush()
+	}
+}
+
+func (sw *serverWriter) finish() {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	sw.finished = true
+}
+
+func requestRemoteAddr(r *http.Request) net.Addr {
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		return addr
+	}
+	return nil
+}
+
+func requestLocalAddr(r *http.Request) net.Addr {
+	addr, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return addr
+}
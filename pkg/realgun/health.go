@@ -0,0 +1,59 @@
+package realgun
+
+import (
+	"context"
+	"time"
+)
+
+const defaultPingTimeout = 15 * time.Second
+
+// checkHealth pings pc whenever nothing was received on it for
+// readIdleTimeout, and closes it if no answer comes within pingTimeout.
+// Connections without streams are only pinged with permitWithoutStream. It
+// returns once pc left the pool.
+func (p *connPool) checkHealth(pc *pooledConn) {
+	timer := time.NewTimer(p.readIdleTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-p.done:
+			return
+		}
+		p.mu.Lock()
+		pooled, streams := p.pooled(pc), pc.streams
+		p.mu.Unlock()
+		if !pooled {
+			return
+		}
+		if idle := pc.conn.idle(); idle < p.readIdleTimeout {
+			timer.Reset(p.readIdleTimeout - idle)
+			continue
+		}
+		timer.Reset(p.readIdleTimeout)
+		if streams == 0 && !p.permitWithoutStream {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), p.pingTimeout)
+		err := pc.cc.Ping(ctx)
+		cancel()
+		if err != nil {
+			p.MarkDead(pc.cc)
+			_ = pc.cc.Close()
+			_ = pc.conn.Close()
+			return
+		}
+	}
+}
+
+// pooled reports whether pc is still in the pool. p.mu must be held.
+func (p *connPool) pooled(pc *pooledConn) bool {
+	for _, conns := range p.conns {
+		for _, c := range conns {
+			if c == pc {
+				return true
+			}
+		}
+	}
+	return false
+}
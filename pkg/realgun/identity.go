@@ -0,0 +1,59 @@
+package realgun
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"net/http"
+)
+
+// PeerIdentity identifies the verified TLS client certificate of an accepted
+// stream.
+type PeerIdentity struct {
+	CommonName     string
+	DNSNames       []string
+	EmailAddresses []string
+	// SHA256 is the fingerprint of the DER-encoded certificate.
+	SHA256 [sha256.Size]byte
+}
+
+// AuthFunc authenticates a new stream by its request and identity, that of
+// its verified client certificate or nil. It returns the user the stream is
+// accepted as, see GunConn.User, or an error refusing it with gRPC status
+// UNAUTHENTICATED and the error as message.
+type AuthFunc func(r *http.Request, identity *PeerIdentity) (user string, err error)
+
+// PeerIdentity returns the identity of the verified client certificate the
+// stream was accepted with, or nil if the server did not verify one, e.g.
+// because its TLSConfig does not set ClientAuth.
+func (g *GunConn) PeerIdentity() *PeerIdentity {
+	return g.peerIdentity
+}
+
+// User returns the user an accepted stream was authenticated as by the
+// server's AuthFunc or, without one, the common name of its verified client
+// certificate. It is "" if there is neither.
+func (g *GunConn) User() string {
+	return g.user
+}
+
+// identityUser returns the user of streams accepted with identity without
+// an AuthFunc, the common name of the certificate.
+func identityUser(identity *PeerIdentity) string {
+	if identity == nil {
+		return ""
+	}
+	return identity.CommonName
+}
+
+func peerIdentity(state *tls.ConnectionState) *PeerIdentity {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	cert := state.VerifiedChains[0][0]
+	return &PeerIdentity{
+		CommonName:     cert.Subject.CommonName,
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+		SHA256:         sha256.Sum256(cert.Raw),
+	}
+}
@@ -0,0 +1,250 @@
+//go:build interop
+// +build interop
+
+package realgun
+
+// The interop tests run gun-lite against the gRPC transport of Xray and
+// v2ray in docker containers:
+//
+//	go test -tags interop -run TestInterop ./pkg/realgun
+//
+// GUN_INTEROP_XRAY and GUN_INTEROP_V2RAY override the images.
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type interopServer struct {
+	name       string
+	image      string
+	entrypoint string
+}
+
+var interopServers = []interopServer{
+	{"xray", interopImage("GUN_INTEROP_XRAY", "teddysun/xray"), "/usr/bin/xray"},
+	{"v2ray", interopImage("GUN_INTEROP_V2RAY", "v2fly/v2fly-core"), "/usr/bin/v2ray"},
+}
+
+var interopModes = []struct {
+	name      string
+	cleartext bool
+	multi     bool
+}{
+	{"tun-tls", false, false},
+	{"tun-h2c", true, false},
+	{"multi-tls", false, true},
+}
+
+func interopImage(env, image string) string {
+	if v := os.Getenv(env); v != "" {
+		return v
+	}
+	return image
+}
+
+func TestInterop(t *testing.T) {
+	if _, err := exec.LookPath("docker"); err != nil {
+		t.Skip("docker not available")
+	}
+	dir := t.TempDir()
+	roots := writeInteropCert(t, dir)
+	echo := startEcho(t)
+
+	for _, server := range interopServers {
+		for _, mode := range interopModes {
+			server, mode := server, mode
+			t.Run(server.name+"/"+mode.name, func(t *testing.T) {
+				port := freePort(t)
+				startInteropServer(t, server, dir, port, echo, mode.cleartext)
+				clientMode := ModeTun
+				if mode.multi {
+					clientMode = ModeMulti
+				}
+				cli := NewGunClient(&Config{
+					RemoteAddr: fmt.Sprintf("127.0.0.1:%d", port),
+					ServerName: "localhost",
+					Cleartext:  mode.cleartext,
+					Mode:       clientMode,
+					RootCAs:    roots,
+				})
+				for i := 0; i < 3; i++ {
+					checkEcho(t, cli)
+				}
+			})
+		}
+	}
+}
+
+// checkEcho sends data on a new stream and expects it back.
+func checkEcho(t *testing.T, cli *Client) {
+	conn, err := cli.DialConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	data := make([]byte, 64<<10)
+	_, _ = rand.Read(data)
+	go func() {
+		_, _ = conn.Write(data)
+	}()
+	got := make([]byte, len(data))
+	if _, err = io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("echoed data differs")
+	}
+}
+
+func startInteropServer(t *testing.T, server interopServer, dir string, port int, echo net.Addr, cleartext bool) {
+	security := "tls"
+	if cleartext {
+		security = "none"
+	}
+	config := map[string]interface{}{
+		"log": map[string]interface{}{"loglevel": "warning"},
+		"inbounds": []interface{}{map[string]interface{}{
+			"listen":   "127.0.0.1",
+			"port":     port,
+			"protocol": "dokodemo-door",
+			"settings": map[string]interface{}{
+				"address": "127.0.0.1",
+				"port":    echo.(*net.TCPAddr).Port,
+				"network": "tcp",
+			},
+			"streamSettings": map[string]interface{}{
+				"network":  "grpc",
+				"security": security,
+				"tlsSettings": map[string]interface{}{
+					"certificates": []interface{}{map[string]interface{}{
+						"certificateFile": "/etc/gun-interop/cert.pem",
+						"keyFile":         "/etc/gun-interop/key.pem",
+					}},
+				},
+				"grpcSettings": map[string]interface{}{"serviceName": "GunService"},
+			},
+		}},
+		"outbounds": []interface{}{map[string]interface{}{"protocol": "freedom"}},
+	}
+	b, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := fmt.Sprintf("config-%d.json", port)
+	if err = os.WriteFile(filepath.Join(dir, name), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := exec.Command("docker", "run", "--rm", "-d", "--network", "host",
+		"-v", dir+":/etc/gun-interop:ro", "--entrypoint", server.entrypoint, server.image,
+		"run", "-c", "/etc/gun-interop/"+name).Output()
+	if err != nil {
+		t.Fatalf("starting %s: %v", server.image, err)
+	}
+	id := strings.TrimSpace(string(out))
+	t.Cleanup(func() {
+		if t.Failed() {
+			logs, _ := exec.Command("docker", "logs", id).CombinedOutput()
+			t.Logf("%s logs:\n%s", server.name, logs)
+		}
+		_ = exec.Command("docker", "rm", "-f", id).Run()
+	})
+
+	deadline := time.Now().Add(20 * time.Second)
+	for {
+		c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err == nil {
+			c.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s did not come up: %v", server.name, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// startEcho starts a TCP echo server for the inbounds to forward to.
+func startEcho(t *testing.T) net.Addr {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+	return listener.Addr()
+}
+
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// writeInteropCert writes a self-signed certificate for localhost to dir and
+// returns a pool trusting it.
+func writeInteropCert(t *testing.T, dir string) *x509.CertPool {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err = os.WriteFile(filepath.Join(dir, "cert.pem"), certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, "key.pem"), keyPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(certPEM)
+	return pool
+}
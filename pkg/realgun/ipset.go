@@ -0,0 +1,87 @@
+package realgun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ipCooldown is how long an address that failed to connect is tried only
+// after the healthy ones.
+const ipCooldown = 30 * time.Second
+
+// ipSet is a fixed set of addresses of the server at addr, tried healthy
+// ones first and in rotation, so connections spread over the set.
+type ipSet struct {
+	addr string
+	ips  []string
+
+	mu       sync.Mutex
+	next     int
+	failedAt []time.Time
+}
+
+func newIPSet(addr string, ips []string) *ipSet {
+	return &ipSet{addr: addr, ips: ips, failedAt: make([]time.Time, len(ips))}
+}
+
+// order returns the indices of the addresses in the order to try them.
+func (s *ipSet) order() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var healthy, failed []int
+	for i := range s.ips {
+		j := (s.next + i) % len(s.ips)
+		if now.Sub(s.failedAt[j]) < ipCooldown {
+			failed = append(failed, j)
+		} else {
+			healthy = append(healthy, j)
+		}
+	}
+	s.next = (s.next + 1) % len(s.ips)
+	// retry the address that failed longest ago first
+	for i := 1; i < len(failed); i++ {
+		for k := i; k > 0 && s.failedAt[failed[k]].Before(s.failedAt[failed[k-1]]); k-- {
+			failed[k], failed[k-1] = failed[k-1], failed[k]
+		}
+	}
+	return append(healthy, failed...)
+}
+
+func (s *ipSet) report(i int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.failedAt[i] = time.Now()
+	} else {
+		s.failedAt[i] = time.Time{}
+	}
+}
+
+// dial connects to the port of addr on the first address of the set that
+// accepts. It stops once ctx is done, and failures of ctx do not count
+// against the addresses.
+func (s *ipSet) dial(ctx context.Context, dial func(addr string) (net.Conn, error), addr string) (net.Conn, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range s.order() {
+		var conn net.Conn
+		conn, err = dial(net.JoinHostPort(s.ips[i], port))
+		if err == nil {
+			s.report(i, nil)
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+			s.report(i, err)
+		}
+	}
+	return nil, err
+}
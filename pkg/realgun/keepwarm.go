@@ -0,0 +1,39 @@
+package realgun
+
+import (
+	"net/http"
+	"time"
+)
+
+// keepWarm sends a HEAD request to path every interval while the client has
+// an open connection but no active stream, until the client shuts down.
+func (cli *Client) keepWarm(interval time.Duration, path string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	u := *cli.url
+	u.Path = path
+	for {
+		select {
+		case <-cli.done:
+			return
+		case <-ticker.C:
+		}
+		if cli.NumActiveStreams() > 0 || cli.NumOpenConns() == 0 {
+			continue
+		}
+		request, err := http.NewRequest(http.MethodHead, u.String(), nil)
+		if err != nil {
+			return
+		}
+		request.Host = cli.hostHeader
+		request.Header["user-agent"] = cli.requestHeader()["user-agent"]
+		request = request.WithContext(withProfileHeader(request.Context(), func(profile *HeaderProfile) http.Header {
+			return http.Header{"user-agent": profile.Header["user-agent"]}
+		}))
+		response, err := cli.do(request)
+		if err != nil {
+			continue
+		}
+		_ = response.Body.Close()
+	}
+}
@@ -0,0 +1,91 @@
+package realgun
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Limits are ceilings on the resources of a Client, or of a Server or Handler
+// as ServerConfig.Limits, which refuse streams beyond them with gRPC status
+// RESOURCE_EXHAUSTED. Zero values mean no limit.
+type Limits struct {
+	// MaxStreams caps the active streams. DialConn fails fast with
+	// ErrOverLimit once it is reached.
+	MaxStreams int
+	// MaxConns caps the open underlying connections. A stream needing a new
+	// connection beyond it fails with ErrOverLimit, reported on its first
+	// Read or Write. A Server closes connections accepted beyond it at once.
+	MaxConns int
+	// MaxStreamsPerConn caps the streams placed on one underlying
+	// connection. Streams beyond it go on another connection, opening a new
+	// one once all are saturated, e.g. to spread the load of many streams
+	// over several TCP connections. Servers ignore it, see
+	// ServerConfig.MaxConcurrentStreams.
+	MaxStreamsPerConn int
+	// MaxBufferedBytes makes DialConn fail fast with ErrOverLimit while the
+	// received bytes buffered across all streams of the process, see
+	// BufferedBytes, are at or above it.
+	MaxBufferedBytes int64
+}
+
+// admitStream reserves an active stream slot, or fails if the limits are reached.
+func (cli *Client) admitStream() error {
+	if limit := cli.limits.MaxBufferedBytes; limit > 0 && BufferedBytes() >= limit {
+		return ErrOverLimit
+	}
+	n := atomic.AddInt64(&cli.activeStreams, 1)
+	if limit := cli.limits.MaxStreams; limit > 0 && n > int64(limit) {
+		atomic.AddInt64(&cli.activeStreams, -1)
+		return ErrOverLimit
+	}
+	return nil
+}
+
+// admitStream reserves an active stream slot of the handler, or reports
+// false if the limits are reached.
+func (h *Handler) admitStream() bool {
+	if limit := h.config.Limits.MaxBufferedBytes; limit > 0 && BufferedBytes() >= limit {
+		return false
+	}
+	n := atomic.AddInt64(&h.activeStreams, 1)
+	if limit := h.config.Limits.MaxStreams; limit > 0 && n > int64(limit) {
+		atomic.AddInt64(&h.activeStreams, -1)
+		return false
+	}
+	return true
+}
+
+// limitedListener closes the connections it accepts beyond max open ones.
+type limitedListener struct {
+	net.Listener
+	max  int64
+	open int64
+}
+
+func (l *limitedListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if atomic.AddInt64(&l.open, 1) > l.max {
+			atomic.AddInt64(&l.open, -1)
+			_ = c.Close()
+			continue
+		}
+		return &limitedConn{Conn: c, l: l}, nil
+	}
+}
+
+// limitedConn gives back its place in a limitedListener once closed.
+type limitedConn struct {
+	net.Conn
+	l         *limitedListener
+	closeOnce sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	c.closeOnce.Do(func() { atomic.AddInt64(&c.l.open, -1) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,230 @@
+package realgun
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// lz4MaxFrame bounds the data of an LZ4 frame, so a write is compressed in
+// pieces and peers cannot make a stream allocate more.
+const lz4MaxFrame = 64 << 10
+
+var errCorruptLZ4 = errors.New("realgun: corrupt lz4 data")
+
+// appendLZ4Frames appends b to dst as frames of at most lz4MaxFrame bytes of
+// data each. A frame is the uvarint length of its data, the uvarint length
+// of the LZ4 block holding it, and the block. A block length of 0 stands for
+// the data stored as is, which incompressible data is.
+func appendLZ4Frames(dst, b []byte) []byte {
+	for len(b) > 0 {
+		data := b
+		if len(data) > lz4MaxFrame {
+			data = data[:lz4MaxFrame]
+		}
+		b = b[len(data):]
+		var n [binary.MaxVarintLen32]byte
+		dst = append(dst, n[:binary.PutUvarint(n[:], uint64(len(data)))]...)
+		// leave room for the varint of the block length, at most 3 bytes
+		start := len(dst)
+		dst = append(dst, 0, 0, 0)
+		dst = appendLZ4Block(dst, data)
+		block := len(dst) - start - 3
+		if block >= len(data) {
+			dst = append(dst[:start], 0)
+			dst = append(dst, data...)
+			continue
+		}
+		m := binary.PutUvarint(n[:], uint64(block))
+		copy(dst[start+m:], dst[start+3:])
+		copy(dst[start:], n[:m])
+		dst = dst[:start+m+block]
+	}
+	return dst
+}
+
+// appendLZ4Block appends src compressed as an LZ4 block, see
+// https://github.com/lz4/lz4/blob/dev/doc/lz4_Block_format.md.
+func appendLZ4Block(dst, src []byte) []byte {
+	const (
+		minMatch = 4
+		// the last match starts 12 bytes before the end at the latest and
+		// the last 5 bytes are literals
+		matchStartLimit = 12
+		literalsAtEnd   = 5
+		hashBits        = 12
+	)
+	var table [1 << hashBits]int32
+	anchor := 0
+	for i := 0; i+matchStartLimit < len(src); {
+		seq := binary.LittleEndian.Uint32(src[i:])
+		h := seq * 2654435761 >> (32 - hashBits)
+		ref := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if ref < 0 || i-ref > 0xffff || binary.LittleEndian.Uint32(src[ref:]) != seq {
+			i++
+			continue
+		}
+		end := i + minMatch
+		for end < len(src)-literalsAtEnd && src[end] == src[ref+end-i] {
+			end++
+		}
+		dst = appendLZ4Sequence(dst, src[anchor:i], i-ref, end-i-minMatch)
+		anchor, i = end, end
+	}
+	// the last sequence has only literals
+	dst = appendLZ4Sequence(dst, src[anchor:], 0, 0)
+	return dst
+}
+
+// appendLZ4Sequence appends the sequence of literals followed by a match of
+// minMatch+matchLen bytes at offset, or just the literals with offset 0.
+func appendLZ4Sequence(dst, literals []byte, offset, matchLen int) []byte {
+	lit, match := len(literals), matchLen
+	if lit > 15 {
+		lit = 15
+	}
+	if match > 15 {
+		match = 15
+	}
+	token := byte(lit<<4 | match)
+	dst = append(dst, token)
+	if len(literals) >= 15 {
+		dst = appendLZ4Length(dst, len(literals)-15)
+	}
+	dst = append(dst, literals...)
+	if offset == 0 {
+		return dst
+	}
+	dst = append(dst, byte(offset), byte(offset>>8))
+	if matchLen >= 15 {
+		dst = appendLZ4Length(dst, matchLen-15)
+	}
+	return dst
+}
+
+func appendLZ4Length(dst []byte, n int) []byte {
+	for ; n >= 0xff; n -= 0xff {
+		dst = append(dst, 0xff)
+	}
+	return append(dst, byte(n))
+}
+
+// decodeLZ4Block appends the size bytes of data of the LZ4 block src to dst.
+func decodeLZ4Block(dst, src []byte, size int) ([]byte, error) {
+	base := len(dst)
+	for i := 0; i < len(src); {
+		token := src[i]
+		i++
+		n, k := int(token>>4), 0
+		if n == 15 {
+			if n, k = readLZ4Length(src[i:], n); k == 0 {
+				return nil, errCorruptLZ4
+			}
+			i += k
+		}
+		if n > len(src)-i || n > size-(len(dst)-base) {
+			return nil, errCorruptLZ4
+		}
+		dst = append(dst, src[i:i+n]...)
+		i += n
+		if i == len(src) {
+			break
+		}
+		if len(src)-i < 2 {
+			return nil, errCorruptLZ4
+		}
+		offset := int(src[i]) | int(src[i+1])<<8
+		i += 2
+		if n, k = int(token&15), 0; n == 15 {
+			if n, k = readLZ4Length(src[i:], n); k == 0 {
+				return nil, errCorruptLZ4
+			}
+			i += k
+		}
+		n += 4
+		if offset == 0 || offset > len(dst)-base || n > size-(len(dst)-base) {
+			return nil, errCorruptLZ4
+		}
+		// copy byte by byte, as the match may overlap its own output
+		for from := len(dst) - offset; n > 0; n-- {
+			dst = append(dst, dst[from])
+			from++
+		}
+	}
+	if len(dst)-base != size {
+		return nil, errCorruptLZ4
+	}
+	return dst, nil
+}
+
+// readLZ4Length adds the extension bytes of a length at the start of b to n,
+// returning the number of bytes read, or 0 if b ends before the length.
+func readLZ4Length(b []byte, n int) (int, int) {
+	for i, c := range b {
+		n += int(c)
+		if c != 0xff {
+			return n, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// lz4Reader reads the data of the frames appendLZ4Frames writes.
+type lz4Reader struct {
+	r     *bufio.Reader
+	block []byte
+	data  []byte
+	// unread is the data of the current frame not read yet
+	unread []byte
+}
+
+func newLZ4Reader(r io.Reader) *lz4Reader {
+	return &lz4Reader{r: bufio.NewReader(r)}
+}
+
+func (z *lz4Reader) Read(b []byte) (int, error) {
+	for len(z.unread) == 0 {
+		if err := z.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, z.unread)
+	z.unread = z.unread[n:]
+	return n, nil
+}
+
+func (z *lz4Reader) readFrame() error {
+	size, err := binary.ReadUvarint(z.r)
+	if err != nil {
+		return err
+	}
+	block, err := binary.ReadUvarint(z.r)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	if size > lz4MaxFrame || block > size {
+		return errCorruptLZ4
+	}
+	if block == 0 {
+		z.data = append(z.data[:0], make([]byte, size)...)
+		if _, err = io.ReadFull(z.r, z.data); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		z.unread = z.data
+		return nil
+	}
+	z.block = append(z.block[:0], make([]byte, block)...)
+	if _, err = io.ReadFull(z.r, z.block); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	if z.data, err = decodeLZ4Block(z.data[:0], z.block, int(size)); err != nil {
+		return err
+	}
+	z.unread = z.data
+	return nil
+}
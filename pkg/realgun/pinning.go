@@ -0,0 +1,68 @@
+package realgun
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+)
+
+var (
+	errPublicKeyMismatch = errors.New("realgun: server public key is not pinned")
+	errPeerChainMismatch = errors.New("realgun: no certificate of the server chain is pinned")
+)
+
+// pinCertificates makes cfg check the certificates presented by servers.
+// With pins, see Config.PinnedPublicKeys, the server public key must be one
+// of pins instead of verifying the chain. With peerPins, see
+// Config.PinnedPeerSHA256, one certificate of the chain must in addition
+// match one of peerPins by its SubjectPublicKeyInfo or itself.
+func pinCertificates(cfg *tls.Config, pins, peerPins [][]byte) {
+	if pins != nil {
+		cfg.InsecureSkipVerify = true
+	}
+	cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errPublicKeyMismatch
+		}
+		if pins != nil {
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			if !pinned(pins, cert.RawSubjectPublicKeyInfo) {
+				return errPublicKeyMismatch
+			}
+		}
+		if peerPins != nil && !chainPinned(peerPins, rawCerts) {
+			return errPeerChainMismatch
+		}
+		return nil
+	}
+}
+
+// chainPinned reports whether the key or the whole of one of rawCerts is
+// pinned.
+func chainPinned(pins, rawCerts [][]byte) bool {
+	for _, raw := range rawCerts {
+		if pinned(pins, raw) {
+			return true
+		}
+		if cert, err := x509.ParseCertificate(raw); err == nil && pinned(pins, cert.RawSubjectPublicKeyInfo) {
+			return true
+		}
+	}
+	return false
+}
+
+// pinned reports whether the SHA-256 of b is one of pins.
+func pinned(pins [][]byte, b []byte) bool {
+	sum := sha256.Sum256(b)
+	for _, pin := range pins {
+		if bytes.Equal(pin, sum[:]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,484 @@
+package realgun
+
+import (
+	"context"
+	"crypto/tls"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const defaultReuseCheckTimeout = 5 * time.Second
+
+// connPool is the http2.ClientConnPool of a Client. Unlike the default pool
+// of http2.Transport it holds on to the underlying connections, so it can
+// check their health before placing a stream on them.
+type connPool struct {
+	transport *http2.Transport
+	dial      dialTLSFunc
+	// reuseCheckAfter, if positive, is the idle time after which a
+	// connection is pinged before reuse
+	reuseCheckAfter   time.Duration
+	reuseCheckTimeout time.Duration
+	// maxStreamsPerConn, if positive, caps the streams placed on a connection
+	maxStreamsPerConn int
+	// endpoints are tried in order when dialing the requested address fails,
+	// or all at once with raceEndpoints
+	endpoints     []string
+	raceEndpoints bool
+	// profiles are the header profiles new connections pick one of
+	profiles []*HeaderProfile
+	// readIdleTimeout, if positive, is the time without reads after which a
+	// connection is pinged, see checkHealth
+	readIdleTimeout     time.Duration
+	pingTimeout         time.Duration
+	permitWithoutStream bool
+
+	// mu protects conns, sessions, dialing, closed and the stream counts of
+	// the connections
+	mu    sync.Mutex
+	conns map[string][]*pooledConn
+	// sessions maps session names to the connection their streams go on
+	sessions map[string]*pooledConn
+	// dialing maps addresses to the dial in flight for them, so concurrent
+	// streams share a new connection
+	dialing map[string]*connDial
+	// closed is set by close, after which new connections are closed
+	// instead of pooled
+	closed bool
+	// done is closed by close
+	done chan struct{}
+}
+
+// connDial is a dial of a new pooled connection that other streams wait for.
+type connDial struct {
+	done chan struct{}
+	// err and canceled, whether the dialing stream gave up, are set before
+	// done is closed
+	err      error
+	canceled bool
+}
+
+type pooledConn struct {
+	cc   *http2.ClientConn
+	conn *trackedConn
+	// profile, if set, is the header profile of all requests on the
+	// connection
+	profile *HeaderProfile
+	// streams counts the open streams placed on the connection
+	streams int
+}
+
+type streamSlotKey struct{}
+
+// streamSlot records the pooled connection a stream was placed on, so that
+// its place is freed when the stream is closed.
+type streamSlot struct {
+	pc *pooledConn
+	// released is set once the stream is closed, after which it takes no
+	// place anymore
+	released bool
+}
+
+func withStreamSlot(ctx context.Context, slot *streamSlot) context.Context {
+	return context.WithValue(ctx, streamSlotKey{}, slot)
+}
+
+func streamSlotOf(ctx context.Context) *streamSlot {
+	slot, _ := ctx.Value(streamSlotKey{}).(*streamSlot)
+	return slot
+}
+
+func newConnPool(transport *http2.Transport, dial dialTLSFunc, config *Config) *connPool {
+	p := &connPool{
+		transport:           transport,
+		dial:                dial,
+		reuseCheckAfter:     config.ReuseCheckAfter,
+		reuseCheckTimeout:   config.ReuseCheckTimeout,
+		maxStreamsPerConn:   config.Limits.MaxStreamsPerConn,
+		endpoints:           append([]string(nil), config.Endpoints...),
+		raceEndpoints:       config.RaceEndpoints,
+		readIdleTimeout:     config.ReadIdleTimeout,
+		pingTimeout:         config.PingTimeout,
+		permitWithoutStream: config.PermitWithoutStream,
+		conns:               make(map[string][]*pooledConn),
+		sessions:            make(map[string]*pooledConn),
+		dialing:             make(map[string]*connDial),
+		done:                make(chan struct{}),
+	}
+	if p.reuseCheckTimeout <= 0 {
+		p.reuseCheckTimeout = defaultReuseCheckTimeout
+	}
+	if p.pingTimeout <= 0 {
+		p.pingTimeout = defaultPingTimeout
+	}
+	return p
+}
+
+// GetClientConn implements http2.ClientConnPool.
+func (p *connPool) GetClientConn(req *http.Request, addr string) (*http2.ClientConn, error) {
+	avoid := avoidedConn(req.Context())
+	session := sessionOf(req.Context())
+	slot := streamSlotOf(req.Context())
+	if pc := p.reserved(addr, avoid, slot); pc != nil {
+		return pc.cc, nil
+	}
+	if pc := p.pinned(addr, session, avoid, slot); pc != nil {
+		return pc.cc, nil
+	}
+	pc, err := p.getConn(req.Context(), addr, avoid, slot)
+	if err != nil {
+		return nil, err
+	}
+	if session != "" {
+		p.mu.Lock()
+		p.sessions[session] = pc
+		p.mu.Unlock()
+	}
+	return pc.cc, nil
+}
+
+// reserve places the stream of req on a connection ahead of the transport
+// and returns the profile of the connection, so the headers of req can be set
+// before the transport takes it. GetClientConn then hands out the same
+// connection, see reserved.
+func (p *connPool) reserve(req *http.Request) (*HeaderProfile, error) {
+	if _, err := p.GetClientConn(req, authorityAddr(req.URL)); err != nil {
+		return nil, err
+	}
+	slot := streamSlotOf(req.Context())
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if slot.pc == nil {
+		return nil, nil
+	}
+	return slot.pc.profile, nil
+}
+
+// reserved returns the pooled connection the stream of slot is placed on, if
+// it is still alive and can take the stream.
+func (p *connPool) reserved(addr string, avoid net.Conn, slot *streamSlot) *pooledConn {
+	if slot == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pc := slot.pc
+	if pc == nil || pc.conn == avoid || !pc.cc.CanTakeNewRequest() {
+		return nil
+	}
+	for _, c := range p.conns[addr] {
+		if c == pc {
+			return pc
+		}
+	}
+	return nil
+}
+
+// authorityAddr returns the address the transport asks the pool for to send
+// a request to u.
+func authorityAddr(u *url.URL) string {
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// pickProfile returns a random one of the profiles, or nil.
+func (p *connPool) pickProfile() *HeaderProfile {
+	if len(p.profiles) == 0 {
+		return nil
+	}
+	return p.profiles[mrand.Intn(len(p.profiles))]
+}
+
+// getConn returns a connection to addr for the stream of slot, placing the
+// stream on it. While a new connection to addr is being dialed, further
+// streams wait for it until their ctx is done, then share it if it has room.
+func (p *connPool) getConn(ctx context.Context, addr string, avoid net.Conn, slot *streamSlot) (*pooledConn, error) {
+	for {
+		if pc := p.reusable(addr, avoid, slot); pc != nil {
+			return pc, nil
+		}
+		p.mu.Lock()
+		d := p.dialing[addr]
+		if d == nil {
+			d = &connDial{done: make(chan struct{})}
+			p.dialing[addr] = d
+			p.mu.Unlock()
+			pc, err := p.dialNew(ctx, addr, slot)
+			p.mu.Lock()
+			delete(p.dialing, addr)
+			p.mu.Unlock()
+			d.err, d.canceled = err, ctx.Err() != nil
+			close(d.done)
+			return pc, err
+		}
+		p.mu.Unlock()
+		select {
+		case <-d.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if d.err != nil && !d.canceled {
+			return nil, d.err
+		}
+	}
+}
+
+// pinned returns the pooled connection the session is pinned to, if it is
+// still alive and can take another stream, placing the stream of slot on it.
+func (p *connPool) pinned(addr, session string, avoid net.Conn, slot *streamSlot) *pooledConn {
+	if session == "" {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pc := p.sessions[session]
+	if pc == nil || pc.conn == avoid || !p.hasRoom(pc, slot) || !pc.cc.CanTakeNewRequest() {
+		return nil
+	}
+	for _, c := range p.conns[addr] {
+		if c == pc {
+			p.place(slot, pc)
+			return pc
+		}
+	}
+	return nil
+}
+
+// hasRoom reports whether pc is below maxStreamsPerConn, not counting the
+// stream of slot. p.mu must be held.
+func (p *connPool) hasRoom(pc *pooledConn, slot *streamSlot) bool {
+	return p.maxStreamsPerConn <= 0 || pc.streams < p.maxStreamsPerConn || slot != nil && slot.pc == pc
+}
+
+// place moves the stream of slot, if any, onto pc, unless the stream was
+// released already, e.g. closed before the transport asked for a connection.
+// p.mu must be held.
+func (p *connPool) place(slot *streamSlot, pc *pooledConn) {
+	if slot == nil || slot.released {
+		return
+	}
+	p.unplace(slot)
+	slot.pc = pc
+	pc.streams++
+}
+
+// unplace frees the place of the stream of slot. p.mu must be held.
+func (p *connPool) unplace(slot *streamSlot) {
+	if slot.pc != nil {
+		slot.pc.streams--
+		slot.pc = nil
+	}
+}
+
+// release frees the place of the stream of slot for good.
+func (p *connPool) release(slot *streamSlot) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	slot.released = true
+	p.unplace(slot)
+}
+
+// connStreams returns the number of open streams on every pooled connection.
+func (p *connPool) connStreams() []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var streams []int
+	for _, conns := range p.conns {
+		for _, pc := range conns {
+			streams = append(streams, pc.streams)
+		}
+	}
+	return streams
+}
+
+// MarkDead implements http2.ClientConnPool.
+func (p *connPool) MarkDead(cc *http2.ClientConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for addr, conns := range p.conns {
+		for i, pc := range conns {
+			if pc.cc == cc {
+				p.conns[addr] = append(conns[:i:i], conns[i+1:]...)
+				p.unpin(pc)
+				pc.conn.state.set(ConnDraining, nil)
+				if len(p.conns[addr]) == 0 {
+					delete(p.conns, addr)
+				}
+				return
+			}
+		}
+	}
+}
+
+// reusable returns a healthy pooled connection to addr other than avoid that
+// can take another stream, placing the stream of slot on it. Connections
+// failing the health check are dropped.
+func (p *connPool) reusable(addr string, avoid net.Conn, slot *streamSlot) *pooledConn {
+	for {
+		var pc *pooledConn
+		p.mu.Lock()
+		for _, c := range p.conns[addr] {
+			if c.conn != avoid && p.hasRoom(c, slot) && c.cc.CanTakeNewRequest() {
+				pc = c
+				p.place(slot, pc)
+				break
+			}
+		}
+		p.mu.Unlock()
+		if pc == nil || p.healthy(pc) {
+			return pc
+		}
+		if slot != nil {
+			p.mu.Lock()
+			p.unplace(slot)
+			p.mu.Unlock()
+		}
+		p.MarkDead(pc.cc)
+		_ = pc.conn.Close()
+	}
+}
+
+// healthy pings pc if it has been idle for longer than reuseCheckAfter.
+func (p *connPool) healthy(pc *pooledConn) bool {
+	if p.reuseCheckAfter <= 0 || pc.conn.idle() < p.reuseCheckAfter {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.reuseCheckTimeout)
+	defer cancel()
+	return pc.cc.Ping(ctx) == nil
+}
+
+// unpin drops the sessions pinned to pc. p.mu must be held.
+func (p *connPool) unpin(pc *pooledConn) {
+	for session, c := range p.sessions {
+		if c == pc {
+			delete(p.sessions, session)
+		}
+	}
+}
+
+// dialNew opens a connection pooled for addr, failing over to the endpoints
+// or racing them.
+func (p *connPool) dialNew(ctx context.Context, addr string, slot *streamSlot) (*pooledConn, error) {
+	addrs := []string{addr}
+	for _, endpoint := range p.endpoints {
+		if endpoint != addr {
+			addrs = append(addrs, endpoint)
+		}
+	}
+	var pc *pooledConn
+	var err error
+	if p.raceEndpoints && len(addrs) > 1 {
+		pc, err = p.race(ctx, addrs)
+	} else {
+		for _, addr := range addrs {
+			if pc, err = p.dialEndpoint(ctx, addr); err == nil || ctx.Err() != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		_ = pc.cc.Close()
+		_ = pc.conn.Close()
+		return nil, ErrClosed
+	}
+	p.conns[addr] = append(p.conns[addr], pc)
+	p.place(slot, pc)
+	p.mu.Unlock()
+	if p.readIdleTimeout > 0 {
+		go p.checkHealth(pc)
+	}
+	return pc, nil
+}
+
+// race dials all addrs at once and returns the first connection completing
+// the HTTP/2 handshake, closing the others.
+func (p *connPool) race(ctx context.Context, addrs []string) (*pooledConn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	type result struct {
+		pc  *pooledConn
+		err error
+	}
+	results := make(chan result, len(addrs))
+	for _, addr := range addrs {
+		go func(addr string) {
+			pc, err := p.dialEndpoint(ctx, addr)
+			results <- result{pc, err}
+		}(addr)
+	}
+	var err error
+	for i := range addrs {
+		r := <-results
+		if r.err != nil {
+			err = r.err
+			continue
+		}
+		cancel()
+		go func(n int) {
+			for ; n > 0; n-- {
+				if r := <-results; r.err == nil {
+					_ = r.pc.cc.Close()
+					_ = r.pc.conn.Close()
+				}
+			}
+		}(len(addrs) - 1 - i)
+		return r.pc, nil
+	}
+	cancel()
+	return nil, err
+}
+
+// dialEndpoint dials addr and performs the HTTP/2 handshake.
+func (p *connPool) dialEndpoint(ctx context.Context, addr string) (*pooledConn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	cfg := new(tls.Config)
+	if p.transport.TLSClientConfig != nil {
+		cfg = p.transport.TLSClientConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	if !hasProto(cfg.NextProtos, http2.NextProtoTLS) {
+		cfg.NextProtos = append([]string{http2.NextProtoTLS}, cfg.NextProtos...)
+	}
+
+	conn, err := p.dial(ctx, "tcp", addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	cc, err := p.transport.NewClientConn(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, &wrappedError{kind: ErrHandshake, err: err}
+	}
+	return &pooledConn{cc: cc, conn: conn.(*trackedConn), profile: p.pickProfile()}, nil
+}
+
+func hasProto(protos []string, proto string) bool {
+	for _, p := range protos {
+		if p == proto {
+			return true
+		}
+	}
+	return false
+}
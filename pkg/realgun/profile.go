@@ -0,0 +1,132 @@
+package realgun
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// HeaderProfile is a set of request headers mimicking a real gRPC client.
+//
+// The order in which headers go on the wire is not part of a profile: the
+// HTTP/2 transport encodes the headers of a request in map order, which
+// differs between requests, and offers no way to set it.
+type HeaderProfile struct {
+	Name   string
+	Header http.Header
+}
+
+var (
+	ProfileGrpcGo = &HeaderProfile{
+		Name: "grpc-go",
+		Header: http.Header{
+			"content-type": []string{"application/grpc"},
+			"user-agent":   []string{"grpc-go/1.36.0"},
+			"te":           []string{"trailers"},
+		},
+	}
+	ProfileGrpcJava = &HeaderProfile{
+		Name: "grpc-java",
+		Header: http.Header{
+			"content-type":         []string{"application/grpc"},
+			"user-agent":           []string{"grpc-java-netty/1.36.0"},
+			"te":                   []string{"trailers"},
+			"grpc-accept-encoding": []string{"gzip"},
+		},
+	}
+	ProfileGrpcSwift = &HeaderProfile{
+		Name: "grpc-swift",
+		Header: http.Header{
+			"content-type":         []string{"application/grpc"},
+			"user-agent":           []string{"grpc-swift-nio/1.0.0"},
+			"te":                   []string{"trailers"},
+			"grpc-accept-encoding": []string{"identity"},
+		},
+	}
+)
+
+// HeaderProfiles lists the built-in profiles.
+var HeaderProfiles = []*HeaderProfile{ProfileGrpcGo, ProfileGrpcJava, ProfileGrpcSwift}
+
+// LookupHeaderProfile returns the built-in profile with the given name, or nil.
+func LookupHeaderProfile(name string) *HeaderProfile {
+	for _, p := range HeaderProfiles {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// requestHeader returns a copy of the headers for a new stream, which are
+// replaced with those of the profile picked for the connection it goes on,
+// see withProfileHeader.
+func (cli *Client) requestHeader() http.Header {
+	if len(cli.profiles) == 0 {
+		return cli.headers.Clone()
+	}
+	return cli.profiles[0].Header.Clone()
+}
+
+// streamHeader returns a copy of the headers of a stream on a connection
+// using profile.
+func (cli *Client) streamHeader(profile *HeaderProfile) http.Header {
+	if cli.compression != CompressionNone {
+		return withCompression(profile.Header, cli.compression)
+	}
+	return profile.Header.Clone()
+}
+
+type profileHeaderKey struct{}
+
+// withProfileHeader makes Client.do send a request with the headers header
+// returns for the profile of the connection it is placed on, so all requests
+// on a connection look like they come from the same client.
+func withProfileHeader(ctx context.Context, header func(*HeaderProfile) http.Header) context.Context {
+	return context.WithValue(ctx, profileHeaderKey{}, header)
+}
+
+func profileHeaderOf(ctx context.Context) func(*HeaderProfile) http.Header {
+	header, _ := ctx.Value(profileHeaderKey{}).(func(*HeaderProfile) http.Header)
+	return header
+}
+
+// do sends request. With profiles, the stream of request is placed on a
+// connection first and a copy of request goes out with the headers of its
+// profile, so the transport never sees the headers change.
+func (cli *Client) do(request *http.Request) (*http.Response, error) {
+	header := profileHeaderOf(request.Context())
+	if header == nil || len(cli.profiles) == 0 {
+		return cli.client.Do(request)
+	}
+	if streamSlotOf(request.Context()) == nil {
+		slot := new(streamSlot)
+		request = request.WithContext(withStreamSlot(request.Context(), slot))
+		defer cli.pool.release(slot)
+	}
+	profile, err := cli.pool.reserve(request)
+	if err != nil {
+		// as the client reports errors of the transport
+		op := request.Method[:1] + strings.ToLower(request.Method[1:])
+		return nil, &url.Error{Op: op, URL: request.URL.String(), Err: err}
+	}
+	if profile != nil {
+		request = request.Clone(request.Context())
+		request.Header = header(profile)
+	}
+	return cli.client.Do(request)
+}
+
+// mergeHeader returns a copy of base with the values of extra replacing
+// those of the same name. Names are lowercased, as HTTP/2 requires.
+func mergeHeader(base, extra http.Header) http.Header {
+	if extra == nil {
+		return base
+	}
+	merged := base.Clone()
+	for k, v := range extra {
+		merged[strings.ToLower(k)] = v
+	}
+	return merged
+}
@@ -0,0 +1,127 @@
+package realgun
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Socks5Proxy is an upstream SOCKS5 proxy the connections to the server are
+// established through.
+type Socks5Proxy struct {
+	Addr string
+	// Username and Password, if set, authenticate with the proxy.
+	Username string
+	Password string
+}
+
+// forwardDialer adapts a DialContextFunc to the dialers of x/net/proxy.
+type forwardDialer DialContextFunc
+
+func (d forwardDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d forwardDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d == nil {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, addr)
+	}
+	return d(ctx, network, addr)
+}
+
+// dialContext returns the function dialing through the proxy by way of
+// forward, which may be nil.
+func (p *Socks5Proxy) dialContext(forward DialContextFunc) DialContextFunc {
+	var auth *proxy.Auth
+	if p.Username != "" || p.Password != "" {
+		auth = &proxy.Auth{User: p.Username, Password: p.Password}
+	}
+	dialer, err := proxy.SOCKS5("tcp", p.Addr, auth, forwardDialer(forward))
+	if err != nil {
+		return func(context.Context, string, string) (net.Conn, error) {
+			return nil, err
+		}
+	}
+	if cd, ok := dialer.(proxy.ContextDialer); ok {
+		return cd.DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialer.Dial(network, addr)
+	}
+}
+
+// HTTPProxy is an upstream HTTP proxy the connections to the server are
+// tunneled through with CONNECT.
+type HTTPProxy struct {
+	Addr string
+	// Username and Password, if set, go in Proxy-Authorization.
+	Username string
+	Password string
+}
+
+// dialContext returns the function dialing through the proxy by way of
+// forward, which may be nil.
+func (p *HTTPProxy) dialContext(forward DialContextFunc) DialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := forwardDialer(forward).DialContext(ctx, network, p.Addr)
+		if err != nil {
+			return nil, err
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			_ = conn.SetDeadline(deadline)
+			defer conn.SetDeadline(time.Time{})
+		}
+		return p.connect(conn, addr)
+	}
+}
+
+// connect asks the proxy on conn for a tunnel to addr.
+func (p *HTTPProxy) connect(conn net.Conn, addr string) (net.Conn, error) {
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if p.Username != "" || p.Password != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(p.Username + ":" + p.Password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := request.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	response, err := http.ReadResponse(br, request)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("realgun: proxy %s: CONNECT %s: %s", p.Addr, addr, response.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a net.Conn whose reads start with the bytes buffered in r.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
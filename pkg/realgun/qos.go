@@ -0,0 +1,103 @@
+package realgun
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// bulkMaxHunkSize bounds the hunks of bulk streams, so writes of
+	// interactive streams get in between them.
+	bulkMaxHunkSize = 16 << 10
+	// bulkMaxYield bounds how long a bulk hunk waits for interactive writes,
+	// so bulk streams do not starve.
+	bulkMaxYield = 50 * time.Millisecond
+)
+
+// Priority is the scheduling class of a stream.
+type Priority int32
+
+const (
+	// PriorityInteractive is the default class.
+	PriorityInteractive Priority = iota
+	// PriorityBulk streams, e.g. downloads, yield to interactive streams of
+	// the same Client while those are writing.
+	PriorityBulk
+)
+
+// Priority returns the scheduling class of the stream.
+func (g *GunConn) Priority() Priority {
+	return Priority(atomic.LoadInt32(&g.priority))
+}
+
+// SetPriority sets the scheduling class of the stream. It has no effect on
+// accepted streams.
+func (g *GunConn) SetPriority(p Priority) {
+	atomic.StoreInt32(&g.priority, int32(p))
+}
+
+// qosScheduler lets the bulk streams of a Client wait for its interactive
+// writes.
+type qosScheduler struct {
+	// bulk counts the writes of bulk streams in flight, accessed
+	// atomically. Interactive writes skip the scheduler while there are none.
+	bulk int32
+
+	mu          sync.Mutex
+	interactive int
+	// started counts the interactive writes ever begun
+	started uint64
+	// idle is closed once no interactive write is in flight
+	idle chan struct{}
+}
+
+// beginInteractive records an interactive write, unless no bulk write is in
+// flight, and reports whether it did so, in which case endInteractive must
+// follow.
+func (s *qosScheduler) beginInteractive() bool {
+	if atomic.LoadInt32(&s.bulk) == 0 {
+		return false
+	}
+	s.mu.Lock()
+	if s.interactive == 0 {
+		s.idle = make(chan struct{})
+	}
+	s.interactive++
+	s.started++
+	s.mu.Unlock()
+	return true
+}
+
+func (s *qosScheduler) endInteractive() {
+	s.mu.Lock()
+	s.interactive--
+	if s.interactive == 0 {
+		close(s.idle)
+	}
+	s.mu.Unlock()
+}
+
+func (s *qosScheduler) beginBulk() { atomic.AddInt32(&s.bulk, 1) }
+func (s *qosScheduler) endBulk()   { atomic.AddInt32(&s.bulk, -1) }
+
+// yield waits until no interactive write is in flight, or bulkMaxYield. A
+// bulk stream yields once per interactive write begun, recorded in seen, so
+// an interactive write stalled on flow control does not hold it back for
+// longer than bulkMaxYield. seen is protected by s.mu.
+func (s *qosScheduler) yield(seen *uint64) {
+	s.mu.Lock()
+	if s.interactive == 0 || *seen == s.started {
+		s.mu.Unlock()
+		return
+	}
+	*seen = s.started
+	idle := s.idle
+	s.mu.Unlock()
+	timer := time.NewTimer(bulkMaxYield)
+	defer timer.Stop()
+	select {
+	case <-idle:
+	case <-timer.C:
+	}
+}
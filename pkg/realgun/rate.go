@@ -0,0 +1,38 @@
+package realgun
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const defaultRateInterval = time.Second
+
+func rateInterval(interval time.Duration) time.Duration {
+	if interval <= 0 {
+		return defaultRateInterval
+	}
+	return interval
+}
+
+// RateFunc receives the read and write rates of a stream in bytes per second.
+type RateFunc func(conn *GunConn, readRate, writeRate float64)
+
+// reportRates calls fn every interval with g's rates over the last interval,
+// until the stream dies.
+func (g *GunConn) reportRates(interval time.Duration, fn RateFunc) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := time.Now()
+	var lastRead, lastWritten int64
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+		case now := <-ticker.C:
+			read, written := atomic.LoadInt64(&g.bytesRead), atomic.LoadInt64(&g.bytesWritten)
+			seconds := now.Sub(last).Seconds()
+			fn(g, float64(read-lastRead)/seconds, float64(written-lastWritten)/seconds)
+			last, lastRead, lastWritten = now, read, written
+		}
+	}
+}
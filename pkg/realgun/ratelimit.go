@@ -0,0 +1,96 @@
+package realgun
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RateLimit is a token bucket refilled with Rate tokens per second and
+// holding at most Burst, one Rate's worth if Burst is not positive. A zero
+// Rate means no limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// bucketSweepInterval is how often keyedBuckets drops buckets that are full
+// again, so keys seen once do not pile up.
+const bucketSweepInterval = time.Minute
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// keyedBuckets holds a token bucket of limit per key, e.g. per client IP.
+type keyedBuckets struct {
+	limit RateLimit
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newKeyedBuckets(limit RateLimit) *keyedBuckets {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	return &keyedBuckets{limit: limit, buckets: make(map[string]*tokenBucket), lastSweep: time.Now()}
+}
+
+func (k *keyedBuckets) burst() float64 {
+	if k.limit.Burst <= 0 {
+		return k.limit.Rate
+	}
+	return float64(k.limit.Burst)
+}
+
+// take takes a token from the bucket of key, reporting whether there was
+// one. A nil keyedBuckets always has one.
+func (k *keyedBuckets) take(key string) bool {
+	if k == nil {
+		return true
+	}
+	now := time.Now()
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if now.Sub(k.lastSweep) >= bucketSweepInterval {
+		k.sweep(now)
+	}
+	b := k.buckets[key]
+	if b == nil {
+		b = &tokenBucket{tokens: k.burst(), last: now}
+		k.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * k.limit.Rate
+	if burst := k.burst(); b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep drops the buckets refilled to their burst by now. k.mu must be held.
+func (k *keyedBuckets) sweep(now time.Time) {
+	for key, b := range k.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*k.limit.Rate >= k.burst() {
+			delete(k.buckets, key)
+		}
+	}
+	k.lastSweep = now
+}
+
+// requestIP returns the IP of the client of r, or its whole address if it
+// has no port.
+func requestIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,124 @@
+package realgun
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// gRPC status codes the package sends.
+const (
+	// grpcCanceled is the code of a stream cancelled by the peer.
+	grpcCanceled = 1
+	// grpcResourceExhausted is the code of a stream refused by limits.
+	grpcResourceExhausted = 8
+	// grpcUnavailable is the code of a stream the server cannot serve.
+	grpcUnavailable = 14
+	// grpcUnauthenticated is the code of a stream refused by authentication.
+	grpcUnauthenticated = 16
+)
+
+// CloseReason tells why a stream ended.
+type CloseReason struct {
+	// Code is a gRPC status code, 0 for an orderly close.
+	Code    uint32
+	Message string
+	// Remote reports whether the reason came from the peer.
+	Remote bool
+}
+
+// CloseWithReason closes the stream, telling the peer why. Accepted streams
+// send the reason as grpc-status and grpc-message trailers. Dialed streams
+// keep it locally: servers see them cancelled.
+func (g *GunConn) CloseWithReason(code uint32, message string) error {
+	g.setCloseReason(&CloseReason{Code: code, Message: message})
+	return g.Close()
+}
+
+// CloseReason returns why the stream ended, or nil if it is open or closed
+// without a reason.
+func (g *GunConn) CloseReason() *CloseReason {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closeReason == nil {
+		return nil
+	}
+	reason := *g.closeReason
+	return &reason
+}
+
+// setCloseReason records reason unless the stream is closed or has a reason
+// already.
+func (g *GunConn) setCloseReason(reason *CloseReason) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closeReason == nil && !g.isClosed() {
+		g.closeReason = reason
+	}
+}
+
+// trailerReason returns the reason in the grpc-status and grpc-message of
+// trailer, or nil if there is none.
+func trailerReason(trailer http.Header) *CloseReason {
+	code, err := strconv.ParseUint(trailer.Get("grpc-status"), 10, 32)
+	if err != nil {
+		return nil
+	}
+	message := trailer.Get("grpc-message")
+	if m, err := url.PathUnescape(message); err == nil {
+		message = m
+	}
+	return &CloseReason{Code: uint32(code), Message: message, Remote: true}
+}
+
+// encodeGrpcMessage percent-encodes message as gRPC requires for
+// grpc-message.
+func encodeGrpcMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		if c := message[i]; c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// AddTrailer adds trailer metadata an accepted stream sends when it ends,
+// e.g. accounting information for cooperating clients, which find it in
+// Trailer. grpc-status and grpc-message are set from the close reason and
+// cannot be added. Dialed streams send no trailers.
+func (g *GunConn) AddTrailer(key, value string) {
+	key = strings.ToLower(key)
+	if key == "grpc-status" || key == "grpc-message" {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.sendTrailer == nil {
+		g.sendTrailer = make(http.Header)
+	}
+	g.sendTrailer[key] = append(g.sendTrailer[key], value)
+}
+
+// writeReasonTrailer sets the trailers telling the client why the stream
+// ended, after those added with AddTrailer.
+func (g *GunConn) writeReasonTrailer(header http.Header) {
+	g.mu.Lock()
+	for key, values := range g.sendTrailer {
+		header[http.TrailerPrefix+key] = values
+	}
+	g.mu.Unlock()
+	reason := g.CloseReason()
+	if reason == nil || reason.Remote {
+		header.Set(http.TrailerPrefix+"grpc-status", "0")
+		return
+	}
+	header.Set(http.TrailerPrefix+"grpc-status", strconv.FormatUint(uint64(reason.Code), 10))
+	if reason.Message != "" {
+		header.Set(http.TrailerPrefix+"grpc-message", encodeGrpcMessage(reason.Message))
+	}
+}
@@ -0,0 +1,187 @@
+package realgun
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+var registry = struct {
+	sync.Mutex
+	clients map[string]*Client
+}{clients: make(map[string]*Client)}
+
+// SharedClient returns the process-wide Client for config, creating it on
+// first use. Configs that only differ in spelling out defaults share a
+// Client, and with it the pooled connections, so code constructing a dialer
+// per request does not end up with hundreds of transports.
+//
+// Configs setting callbacks or middlewares cannot be compared and always get
+// a Client of their own.
+func SharedClient(config *Config) *Client {
+	key, ok := configKey(config)
+	if !ok {
+		return NewGunClient(config)
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	if cli, ok := registry.clients[key]; ok {
+		return cli
+	}
+	cli := NewGunClient(config)
+	registry.clients[key] = cli
+	return cli
+}
+
+// unregister drops cli from the registry if it is a shared Client.
+func unregister(cli *Client) {
+	registry.Lock()
+	defer registry.Unlock()
+	for key, c := range registry.clients {
+		if c == cli {
+			delete(registry.clients, key)
+		}
+	}
+}
+
+// configKey returns a hash of the config with defaults spelled out, or false
+// if config holds values which cannot be compared, i.e. funcs. The fields are
+// walked by reflection, so new fields are covered without listing them here;
+// only their defaults need normalizing.
+func configKey(config *Config) (string, bool) {
+	c := *config
+	if c.ServiceName == "" {
+		c.ServiceName = "GunService"
+	}
+	if c.Path == "" {
+		c.Path = c.Mode.methodPath(c.ServiceName)
+	}
+	if c.KeepWarmInterval <= 0 {
+		c.KeepWarmInterval, c.KeepWarmPath = 0, ""
+	}
+	if c.KeepWarmPath == "" {
+		c.KeepWarmPath = "/"
+	}
+	if c.ReuseCheckAfter <= 0 {
+		c.ReuseCheckAfter, c.ReuseCheckTimeout = 0, 0
+	}
+	if c.ReuseCheckTimeout <= 0 {
+		c.ReuseCheckTimeout = defaultReuseCheckTimeout
+	}
+	if len(c.RetryStatuses) == 0 {
+		c.MaxRetries = 0
+	} else if c.MaxRetries <= 0 {
+		c.MaxRetries = defaultMaxRetries
+	}
+	if c.FirstFlightSize < 0 {
+		c.FirstFlightSize = 0
+	}
+	c.MaxWriteSize = maxWriteSize(c.MaxWriteSize)
+	if c.ReadIdleTimeout <= 0 {
+		c.ReadIdleTimeout, c.PingTimeout, c.PermitWithoutStream = 0, 0, false
+	}
+	if c.PingTimeout <= 0 {
+		c.PingTimeout = defaultPingTimeout
+	}
+	if c.SessionCacheSize < 0 || c.SessionCache != nil {
+		c.SessionCacheSize = -1
+	} else if c.SessionCacheSize == 0 {
+		c.SessionCacheSize = 64
+	}
+	if c.DialTimeout < 0 {
+		c.DialTimeout = 0
+	}
+	if c.ResponseHeaderTimeout < 0 {
+		c.ResponseHeaderTimeout = 0
+	}
+	c.Headers = mergeHeader(http.Header{}, c.Headers)
+
+	h := sha256.New()
+	if !hashValue(h, reflect.ValueOf(c)) {
+		return "", false
+	}
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+var packagePath = reflect.TypeOf(Config{}).PkgPath()
+
+// hashValue writes v to h, reporting false if v holds a func. Pointers to the
+// structs of this package, such as proxies and header profiles, are hashed by
+// value, other pointers and interfaces, such as those to a tls.Config, by
+// identity. Nil and empty slices and maps hash alike.
+func hashValue(h io.Writer, v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Func:
+		if !v.IsNil() {
+			return false
+		}
+		fmt.Fprint(h, "nil")
+	case reflect.Ptr:
+		switch {
+		case v.IsNil():
+			fmt.Fprint(h, "nil")
+		case v.Elem().Kind() == reflect.Struct && v.Type().Elem().PkgPath() == packagePath:
+			fmt.Fprint(h, "&")
+			return hashValue(h, v.Elem())
+		default:
+			fmt.Fprintf(h, "%#x", v.Pointer())
+		}
+	case reflect.Interface:
+		if v.IsNil() {
+			fmt.Fprint(h, "nil")
+			return true
+		}
+		fmt.Fprintf(h, "%s:", v.Elem().Type())
+		return hashValue(h, v.Elem())
+	case reflect.Slice:
+		fmt.Fprintf(h, "[%d:", v.Len())
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			_, _ = h.Write(v.Bytes())
+		} else {
+			for i := 0; i < v.Len(); i++ {
+				if !hashValue(h, v.Index(i)) {
+					return false
+				}
+				fmt.Fprint(h, ",")
+			}
+		}
+		fmt.Fprint(h, "]")
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+		})
+		fmt.Fprintf(h, "map[%d:", len(keys))
+		for _, k := range keys {
+			if !hashValue(h, k) {
+				return false
+			}
+			fmt.Fprint(h, "=")
+			if !hashValue(h, v.MapIndex(k)) {
+				return false
+			}
+			fmt.Fprint(h, ",")
+		}
+		fmt.Fprint(h, "]")
+	case reflect.Struct:
+		fmt.Fprint(h, "{")
+		for i := 0; i < v.NumField(); i++ {
+			fmt.Fprintf(h, "%s=", v.Type().Field(i).Name)
+			if !hashValue(h, v.Field(i)) {
+				return false
+			}
+			fmt.Fprint(h, ";")
+		}
+		fmt.Fprint(h, "}")
+	case reflect.String:
+		fmt.Fprintf(h, "%q", v.String())
+	default:
+		fmt.Fprintf(h, "%v", v)
+	}
+	return true
+}
@@ -0,0 +1,54 @@
+package realgun
+
+import (
+	"context"
+	"io"
+)
+
+// ReplayCapture sends capture, a recording of the request body of a stream
+// as it went on the wire, verbatim on a new stream, and returns the raw
+// response body up to the end of the stream. The capture is not framed, so
+// malformed messages reach the server as recorded, e.g. to reproduce interop
+// bugs with other gun implementations.
+func (cli *Client) ReplayCapture(capture io.Reader) ([]byte, error) {
+	g, err := cli.dial(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer g.Close()
+	if _, err = io.Copy(g.writer, capture); err != nil {
+		return nil, err
+	}
+	if c, ok := g.writer.(io.Closer); ok {
+		_ = c.Close()
+	}
+	return io.ReadAll(g.reader)
+}
+
+// DecodeCapture parses capture, a recording of a response body, the way
+// streams of cli do, and returns the payloads of its messages.
+func (cli *Client) DecodeCapture(capture io.Reader) ([][]byte, error) {
+	g := newGunConn(capture, io.Discard, io.NopCloser(nil), nil, nil)
+	defer g.Close()
+	g.lenient = cli.lenient
+	if cli.resync {
+		g.enableResync()
+	}
+	var messages [][]byte
+	for {
+		// a zero-length read keeps the whole message in toRead
+		if _, err := g.read(nil); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return messages, err
+		}
+		message := []byte{}
+		if g.toRead != nil {
+			message = append(message, g.toRead[g.readAt:]...)
+			g.toRead = nil
+			g.releaseHeld()
+		}
+		messages = append(messages, message)
+	}
+}
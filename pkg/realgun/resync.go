@@ -0,0 +1,126 @@
+package realgun
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log"
+
+	"ekyu.moe/leb128"
+)
+
+// resyncMaxHunkSize bounds the gRPC message length considered plausible
+// while scanning for a hunk boundary.
+const resyncMaxHunkSize = 1 << 24
+
+func (g *GunConn) enableResync() {
+	g.rewound = &rewindReader{r: g.reader}
+	g.buffered = bufio.NewReader(g.rewound)
+	g.reader = g.buffered
+}
+
+// rewindReader reads the bytes put back by rewind before those of r.
+type rewindReader struct {
+	pending []byte
+	r       io.Reader
+}
+
+func (r *rewindReader) Read(b []byte) (int, error) {
+	if len(r.pending) > 0 {
+		n := copy(b, r.pending)
+		r.pending = r.pending[n:]
+		return n, nil
+	}
+	return r.r.Read(b)
+}
+
+// rewind puts b back in front of the unread bytes, e.g. the rest of a
+// message that turned out to be malformed after its header passed for a
+// hunk.
+func (g *GunConn) rewind(b []byte) {
+	buffered, _ := g.buffered.Peek(g.buffered.Buffered())
+	pending := make([]byte, 0, len(b)+len(buffered)+len(g.rewound.pending))
+	pending = append(append(append(pending, b...), buffered...), g.rewound.pending...)
+	g.rewound.pending = pending
+	g.buffered.Reset(g.rewound)
+}
+
+// syncToHunk discards bytes until the buffered reader is positioned at the
+// start of a plausible hunk, scanning already if the reader is not where a
+// message ended. It only peeks bytes belonging to the candidate hunk, so it
+// never blocks on data the peer has not sent yet.
+func (g *GunConn) syncToHunk(scanning bool) error {
+	skipped := 0
+	for {
+		ok, err := g.plausibleHunk(scanning || skipped > 0)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if skipped > 0 {
+				log.Printf("realgun: %v: skipped %d bytes to resynchronize", g, skipped)
+			}
+			return nil
+		}
+		_, _ = g.buffered.Discard(1)
+		skipped++
+	}
+}
+
+// plausibleHunk reports whether the buffered reader is positioned at what
+// looks like an uncompressed message. Unless scanning, that is any message
+// starting with a protobuf field. While scanning garbage, where runs of
+// zeros and stray field tags are common, empty messages are refused, a data
+// field must fit the message and other messages need to be buffered and to
+// parse. The message is parsed again as it is read, see readHunk.
+func (g *GunConn) plausibleHunk(scanning bool) (bool, error) {
+	h, err := g.buffered.Peek(5)
+	if err != nil {
+		return false, err
+	}
+	if h[0] != 0 {
+		return false, nil
+	}
+	grpcPayloadLen := binary.BigEndian.Uint32(h[1:5])
+	if grpcPayloadLen == 0 {
+		return !scanning, nil
+	}
+	if grpcPayloadLen > resyncMaxHunkSize {
+		return false, nil
+	}
+	if h, err = g.buffered.Peek(6); err != nil {
+		return false, err
+	}
+	tag := h[5]
+	field, wireType := tag>>3, tag&7
+	switch {
+	case tag == hunkDataField<<3|wireBytes:
+	case field == 0 || tag&0x80 != 0 || wireType != wireVarint && wireType != wireFixed64 && wireType != wireBytes && wireType != wireFixed32:
+		// gun messages have no field numbers above 15
+		return false, nil
+	case !scanning:
+		return true, nil
+	default:
+		n := 5 + int(grpcPayloadLen)
+		if g.buffered.Buffered() < n {
+			return false, nil
+		}
+		h, _ = g.buffered.Peek(n)
+		_, _, err = decodeHunk(h[5:], g.lenient)
+		return err == nil, nil
+	}
+	for k := 1; k <= 10 && 1+k <= int(grpcPayloadLen); k++ {
+		h, err = g.buffered.Peek(6 + k)
+		if err != nil {
+			return false, err
+		}
+		if h[5+k]&0x80 != 0 {
+			continue
+		}
+		protobufPayloadLen, _ := leb128.DecodeUleb128(h[6:])
+		want := protobufPayloadLen + uint64(k) + 1
+		// further fields may follow, e.g. the payloads of a MultiHunk
+		return want <= uint64(grpcPayloadLen), nil
+	}
+	return false, nil
+}
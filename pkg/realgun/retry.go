@@ -0,0 +1,184 @@
+package realgun
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+)
+
+const (
+	defaultMaxRetries = 1
+	// maxReplayBytes caps the bytes kept for replay until the response
+	// status is known. Streams that wrote more are not retried.
+	maxReplayBytes = 64 << 10
+)
+
+var errStaleAttempt = errors.New("realgun: request attempt superseded by a retry")
+
+type avoidConnKey struct{}
+
+// avoidedConn returns the connection a retried request must not go on.
+func avoidedConn(ctx context.Context) net.Conn {
+	conn, _ := ctx.Value(avoidConnKey{}).(net.Conn)
+	return conn
+}
+
+// retryable reports whether a response with the given status is retried.
+func (cli *Client) retryable(status int) bool {
+	for _, s := range cli.retryStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// roundTrip performs the request of a stream, retrying it on another
+// connection while the server responds with a retryable status.
+func (cli *Client) roundTrip(request *http.Request, conn *GunConn) (*http.Response, error) {
+	if len(cli.retryStatuses) == 0 {
+		return cli.do(request)
+	}
+	body := &replayBody{r: request.Body, replayable: true}
+	var avoid net.Conn
+	for attempt := 0; ; attempt++ {
+		var used net.Conn
+		ctx := context.WithValue(request.Context(), avoidConnKey{}, avoid)
+		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) { used = info.Conn },
+		})
+		req := request.Clone(ctx)
+		req.Body = body.attempt()
+		response, err := cli.do(req)
+		if err != nil {
+			return nil, err
+		}
+		if attempt < cli.maxRetries && cli.retryable(response.StatusCode) && body.rewind() {
+			log.Printf("realgun: %v: retrying on status %s", conn, response.Status)
+			_ = response.Body.Close()
+			avoid = used
+			continue
+		}
+		body.commit()
+		return response, nil
+	}
+}
+
+// replayBody shares a request body between the attempts of a request. Bytes
+// read before the response status is known are kept, so a retry can send
+// them again.
+type replayBody struct {
+	r io.ReadCloser
+
+	mu      sync.Mutex
+	current int
+	// replayable is cleared once the request is committed to an attempt or
+	// buf would outgrow maxReplayBytes
+	replayable bool
+	// buf holds the bytes read from r, from the start while replayable and
+	// from off otherwise; off is the position of the current attempt
+	buf []byte
+	off int
+}
+
+func (b *replayBody) attempt() *attemptBody {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return &attemptBody{b: b, n: b.current}
+}
+
+// rewind supersedes the current attempt. It reports false if the bytes sent
+// so far can no longer be replayed.
+func (b *replayBody) rewind() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.replayable {
+		return false
+	}
+	b.current++
+	b.off = 0
+	return true
+}
+
+func (b *replayBody) commit() {
+	b.mu.Lock()
+	b.replayable = false
+	b.compact()
+	b.mu.Unlock()
+}
+
+// compact drops the bytes sent by the current attempt. b.mu must be held.
+func (b *replayBody) compact() {
+	if b.replayable {
+		return
+	}
+	if b.off == len(b.buf) {
+		b.buf = nil
+	} else {
+		b.buf = b.buf[b.off:]
+	}
+	b.off = 0
+}
+
+type attemptBody struct {
+	b *replayBody
+	n int
+}
+
+func (a *attemptBody) Read(p []byte) (int, error) {
+	b := a.b
+	b.mu.Lock()
+	if a.n != b.current {
+		b.mu.Unlock()
+		return 0, errStaleAttempt
+	}
+	if b.off < len(b.buf) {
+		n := copy(p, b.buf[b.off:])
+		b.off += n
+		b.compact()
+		b.mu.Unlock()
+		return n, nil
+	}
+	b.mu.Unlock()
+
+	n, err := b.r.Read(p)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	stale := a.n != b.current
+	if !b.replayable && !stale && len(b.buf) == 0 {
+		return n, err
+	}
+	// superseded attempts may have queued bytes in the meantime, which go first
+	b.buf = append(b.buf, p[:n]...)
+	if len(b.buf) > maxReplayBytes {
+		b.replayable = false
+	}
+	if stale {
+		b.compact()
+		return 0, errStaleAttempt
+	}
+	n = copy(p, b.buf[b.off:])
+	b.off += n
+	b.compact()
+	if b.off < len(b.buf) {
+		return n, nil
+	}
+	return n, err
+}
+
+// Close closes the shared body once the attempt is the one committed to.
+func (a *attemptBody) Close() error {
+	b := a.b
+	b.mu.Lock()
+	last := a.n == b.current && !b.replayable
+	b.mu.Unlock()
+	if last {
+		return b.r.Close()
+	}
+	return nil
+}
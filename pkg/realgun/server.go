@@ -0,0 +1,205 @@
+package realgun
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// ServerConfig configures a Server or Handler.
+type ServerConfig struct {
+	ServiceName string
+	// Path, if set, replaces the /{ServiceName}/Tun and
+	// /{ServiceName}/TunMulti paths, see Config.
+	Path string
+	// TLSConfig, if set, makes the server terminate TLS. Otherwise it speaks
+	// cleartext h2c, e.g. behind a TLS-terminating reverse proxy.
+	TLSConfig *tls.Config
+	// LenientRead, Resync, AdaptiveHunkSize and Middlewares apply to accepted
+	// conns as they do to dialed ones, see Config.
+	LenientRead      bool
+	Resync           bool
+	AdaptiveHunkSize bool
+	Middlewares      []Middleware
+	// ForwardTo, if set, is the address of a backend every stream is relayed
+	// to, a unix socket if it starts with "unix:", e.g. "unix:/run/app.sock".
+	// Streams then do not go to Accept or the serve function of a Handler.
+	// Streams the backend refuses end with gRPC status UNAVAILABLE.
+	ForwardTo string
+	// DebugServices also serves /{ServiceName}/Echo, sending back all data
+	// of a stream, and /{ServiceName}/Discard, reading it to its end, for
+	// testing throughput and correctness from any gun client. Their streams
+	// do not go to Accept or the serve function of a Handler.
+	DebugServices bool
+	// Strictness selects which requests are taken for streams, see
+	// Strictness.
+	Strictness Strictness
+	// OnRate and RateInterval report the rates of accepted conns, see Config.
+	OnRate       RateFunc
+	RateInterval time.Duration
+	// Sniffer, if set, inspects the first bytes of every accepted stream
+	// before it is handed out, see Sniffed. Streams silent for SniffTimeout,
+	// one second by default, are handed out without waiting further.
+	Sniffer      Sniffer
+	SniffTimeout time.Duration
+	// Authenticate, if set, decides which streams are accepted and as which
+	// user, e.g. by the identity of the client certificate when TLSConfig
+	// requires one.
+	Authenticate AuthFunc
+	// OnStreamEnd, if set, receives the log of every stream once it ended,
+	// e.g. to feed a logging stack.
+	OnStreamEnd StreamLogFunc
+	// IPStreamRate and UserStreamRate limit the rate of new streams per
+	// client IP and per user, see GunConn.User. Streams beyond them are
+	// refused with gRPC status RESOURCE_EXHAUSTED.
+	IPStreamRate   RateLimit
+	UserStreamRate RateLimit
+	// UserUploadRate and UserDownloadRate cap the bytes per second all
+	// streams of a user read from and write to their client. Streams
+	// without a user are not capped.
+	UserUploadRate   float64
+	UserDownloadRate float64
+	// Compression accepts streams of clients with Compression enabled, with
+	// either codec, which are rejected otherwise. Sniffer does not see their
+	// data.
+	Compression bool
+	// InitialWindowSize and InitialConnWindowSize are the HTTP/2
+	// flow-control windows granted to clients per stream and per connection,
+	// 4MB and 16MB by default. Uploads over links with a large
+	// bandwidth-delay product are capped at one window per round trip.
+	InitialWindowSize     int32
+	InitialConnWindowSize int32
+	// MaxConcurrentStreams, MaxReadFrameSize and IdleTimeout tune the
+	// HTTP/2 server: the streams a client may open at once on a connection,
+	// 250 by default, the largest frame it may send, 1MB by default, and how
+	// long a connection without streams stays open, forever by default.
+	MaxConcurrentStreams uint32
+	MaxReadFrameSize     uint32
+	IdleTimeout          time.Duration
+	// Admit, if set, is asked for every new stream passing the other
+	// limits, e.g. for custom load shedding.
+	Admit AdmitFunc
+	// Limits caps the streams and buffered bytes of the server, and the
+	// connections of a Server, see Limits.
+	Limits Limits
+}
+
+// Default flow-control windows of the server. The client transport grants
+// servers 4MB per stream and 1GB per connection.
+const (
+	defaultInitialWindowSize     = 4 << 20
+	defaultInitialConnWindowSize = 16 << 20
+)
+
+// Server terminates gun streams over HTTP/2 and hands them out as net.Conn
+// through Accept, like a net.Listener.
+//
+// Requests for the /{ServiceName}/Tun and /{ServiceName}/TunMulti paths are
+// accepted, including paths randomized by clients using RandomPathSegment or
+// RandomPathQuery. Both methods are served alike, see Mode.
+type Server struct {
+	handler    *Handler
+	listener   net.Listener
+	httpServer *http.Server
+
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+	// err is set before done is closed
+	err error
+}
+
+// NewGunServer returns a Server accepting gun streams on listener.
+func NewGunServer(listener net.Listener, config *ServerConfig) *Server {
+	s := &Server{
+		listener: listener,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	s.handler = newHandler(config, s.serve)
+	s.httpServer = &http.Server{Handler: s}
+	h2Server := newH2Server(config)
+	if config.Limits.MaxConns > 0 {
+		listener = &limitedListener{Listener: listener, max: int64(config.Limits.MaxConns)}
+	}
+	if config.TLSConfig != nil {
+		s.httpServer.TLSConfig = config.TLSConfig.Clone()
+		_ = http2.ConfigureServer(s.httpServer, h2Server)
+		listener = tls.NewListener(listener, s.httpServer.TLSConfig)
+	} else {
+		s.httpServer.Handler = h2c.NewHandler(s, h2Server)
+	}
+	go func() {
+		s.fail(s.httpServer.Serve(listener))
+	}()
+	return s
+}
+
+// newH2Server returns the HTTP/2 server tuned by config.
+func newH2Server(config *ServerConfig) *http2.Server {
+	h2Server := &http2.Server{
+		MaxConcurrentStreams:         config.MaxConcurrentStreams,
+		MaxReadFrameSize:             config.MaxReadFrameSize,
+		IdleTimeout:                  config.IdleTimeout,
+		MaxUploadBufferPerStream:     config.InitialWindowSize,
+		MaxUploadBufferPerConnection: config.InitialConnWindowSize,
+	}
+	if h2Server.MaxUploadBufferPerStream <= 0 {
+		h2Server.MaxUploadBufferPerStream = defaultInitialWindowSize
+	}
+	if h2Server.MaxUploadBufferPerConnection <= 0 {
+		h2Server.MaxUploadBufferPerConnection = defaultInitialConnWindowSize
+	}
+	return h2Server
+}
+
+// Accept waits for and returns the next gun stream. With ForwardTo, streams
+// are relayed instead and Accept waits until the server is closed.
+func (s *Server) Accept() (net.Conn, error) {
+	select {
+	case conn := <-s.conns:
+		return conn, nil
+	case <-s.done:
+		return nil, s.err
+	}
+}
+
+// Close stops the server, closing the listener and all active streams.
+func (s *Server) Close() error {
+	s.fail(ErrClosed)
+	return s.httpServer.Close()
+}
+
+// Addr returns the listener's network address.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+func (s *Server) fail(err error) {
+	s.closeOnce.Do(func() {
+		s.err = err
+		close(s.done)
+	})
+}
+
+// ServeHTTP implements http.Handler, serving a single gun stream.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// serve hands conn out to Accept and keeps the stream open until it is closed.
+func (s *Server) serve(g *GunConn, conn net.Conn) {
+	select {
+	case s.conns <- conn:
+	case <-g.ctx.Done():
+		return
+	case <-s.done:
+		return
+	}
+	<-g.ctx.Done()
+}
@@ -0,0 +1,18 @@
+package realgun
+
+import "context"
+
+type sessionKey struct{}
+
+// WithSession returns a context placing the streams dialed with it through
+// DialConnContext on the same connection as the other streams of session,
+// for tunneled protocols sensitive to the client address changing. If that
+// connection dies or is full, the session is pinned to another one.
+func WithSession(ctx context.Context, session string) context.Context {
+	return context.WithValue(ctx, sessionKey{}, session)
+}
+
+func sessionOf(ctx context.Context) string {
+	session, _ := ctx.Value(sessionKey{}).(string)
+	return session
+}
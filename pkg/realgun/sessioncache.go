@@ -0,0 +1,124 @@
+//go:build go1.21
+// +build go1.21
+
+package realgun
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// persistedSession is a TLS session as stored in the file of a
+// fileSessionCache.
+type persistedSession struct {
+	Key    string `json:"key"`
+	Ticket []byte `json:"ticket"`
+	State  []byte `json:"state"`
+}
+
+// fileSessionCache is an LRU cache of TLS sessions saved to a file on every
+// change, so sessions survive restarts.
+type fileSessionCache struct {
+	tls.ClientSessionCache
+	path     string
+	capacity int
+
+	mu sync.Mutex
+	// sessions are the saved sessions, oldest first
+	sessions []persistedSession
+}
+
+// NewFileSessionCache returns a TLS session cache of capacity sessions, 64 if
+// it is not positive, kept in the file at path so reconnects resume sessions
+// across restarts, see Config.SessionCache. Sessions saved there before are
+// loaded. The file holds session secrets, and is created readable by the
+// owner only.
+func NewFileSessionCache(path string, capacity int) (tls.ClientSessionCache, error) {
+	if capacity <= 0 {
+		capacity = 64
+	}
+	c := &fileSessionCache{ClientSessionCache: tls.NewLRUClientSessionCache(capacity), path: path, capacity: capacity}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, &c.sessions); err != nil {
+		return nil, err
+	}
+	if len(c.sessions) > capacity {
+		c.sessions = c.sessions[len(c.sessions)-capacity:]
+	}
+	kept := c.sessions[:0]
+	for _, s := range c.sessions {
+		state, err := tls.ParseSessionState(s.State)
+		if err != nil {
+			// e.g. saved by another Go version
+			continue
+		}
+		session, err := tls.NewResumptionState(s.Ticket, state)
+		if err != nil {
+			continue
+		}
+		c.ClientSessionCache.Put(s.Key, session)
+		kept = append(kept, s)
+	}
+	c.sessions = kept
+	return c, nil
+}
+
+func (c *fileSessionCache) Put(key string, cs *tls.ClientSessionState) {
+	c.ClientSessionCache.Put(key, cs)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, s := range c.sessions {
+		if s.Key == key {
+			c.sessions = append(c.sessions[:i], c.sessions[i+1:]...)
+			break
+		}
+	}
+	if cs != nil {
+		ticket, state, err := cs.ResumptionState()
+		if err != nil || state == nil {
+			return
+		}
+		b, err := state.Bytes()
+		if err != nil {
+			return
+		}
+		c.sessions = append(c.sessions, persistedSession{Key: key, Ticket: ticket, State: b})
+		if len(c.sessions) > c.capacity {
+			c.sessions = c.sessions[1:]
+		}
+	}
+	_ = c.save()
+}
+
+// save writes the sessions to a temporary file renamed over the file, so
+// readers never see it half written. c.mu must be held.
+func (c *fileSessionCache) save() error {
+	b, err := json.Marshal(c.sessions)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), c.path)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,17 @@
+//go:build !go1.21
+// +build !go1.21
+
+package realgun
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+var errSessionCacheUnsupported = errors.New("realgun: saving TLS sessions to a file needs Go 1.21")
+
+// NewFileSessionCache returns a TLS session cache kept in a file. Before Go
+// 1.21 TLS sessions cannot be serialized, and it fails.
+func NewFileSessionCache(path string, capacity int) (tls.ClientSessionCache, error) {
+	return nil, errSessionCacheUnsupported
+}
@@ -0,0 +1,75 @@
+//go:build go1.21
+// +build go1.21
+
+package realgun
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileSessionCache(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), DNSNames: []string{"example.com"}, NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	path := filepath.Join(t.TempDir(), "sessions")
+	handshake := func(cache tls.ClientSessionCache) bool {
+		c, s := net.Pipe()
+		defer c.Close()
+		defer s.Close()
+		go func() {
+			server := tls.Server(s, serverConfig)
+			if server.Handshake() == nil {
+				// the client reads the session ticket before this
+				_, _ = server.Write([]byte{0})
+			}
+		}()
+		client := tls.Client(c, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true, ClientSessionCache: cache})
+		if _, err := client.Read(make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+		return client.ConnectionState().DidResume
+	}
+
+	cache, err := NewFileSessionCache(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if handshake(cache) {
+		t.Fatal("resumed without a saved session")
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("session file not saved for the owner only: %v %v", info, err)
+	}
+	// a restart loads the session from the file
+	cache, err = NewFileSessionCache(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !handshake(cache) {
+		t.Fatal("session from the file not resumed")
+	}
+
+	if err = os.WriteFile(path, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewFileSessionCache(path, 0); err == nil {
+		t.Fatal("corrupt session file loaded")
+	}
+}
@@ -0,0 +1,95 @@
+package realgun
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+const defaultSniffTimeout = time.Second
+
+// Sniffer inspects head, the first bytes the peer sent on a stream, and
+// returns metadata describing the tunneled protocol, e.g. the host it is
+// destined to. head holds at least the first message, and must not be
+// retained.
+type Sniffer func(head []byte) string
+
+// Sniffed returns the metadata the server's Sniffer attached to the stream,
+// or "" if there is none (yet).
+func (g *GunConn) Sniffed() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.sniffed
+}
+
+// sniff peeks the first message of the stream and passes it to sniffer. It
+// waits at most timeout; reads wait for the sniffer either way.
+func (g *GunConn) sniff(sniffer Sniffer, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = defaultSniffTimeout
+	}
+	g.sniffing = make(chan struct{})
+	go func() {
+		defer close(g.sniffing)
+		for g.toRead == nil {
+			// a zero-length read keeps the whole message in toRead
+			if _, err := g.read(nil); err != nil {
+				return
+			}
+		}
+		sniffed := sniffer(g.toRead[g.readAt:])
+		g.mu.Lock()
+		g.sniffed = sniffed
+		g.mu.Unlock()
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-g.sniffing:
+	case <-timer.C:
+	}
+}
+
+// SniffHost is a Sniffer returning the server name of a TLS ClientHello or
+// the Host of an HTTP/1 request, or "" for other protocols.
+func SniffHost(head []byte) string {
+	if len(head) > 0 && head[0] == 0x16 {
+		return sniffServerName(head)
+	}
+	request, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+	if err != nil {
+		return ""
+	}
+	return request.Host
+}
+
+var errSniffed = errors.New("sniffed")
+
+// sniffServerName runs a TLS handshake on head up to the ClientHello.
+func sniffServerName(head []byte) string {
+	var serverName string
+	_ = tls.Server(sniffConn{bytes.NewReader(head)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errSniffed
+		},
+	}).Handshake()
+	return serverName
+}
+
+// sniffConn is a net.Conn reading from a buffer and discarding writes.
+type sniffConn struct {
+	*bytes.Reader
+}
+
+func (sniffConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (sniffConn) Close() error                       { return nil }
+func (sniffConn) LocalAddr() net.Addr                { return nil }
+func (sniffConn) RemoteAddr() net.Addr               { return nil }
+func (sniffConn) SetDeadline(t time.Time) error      { return nil }
+func (sniffConn) SetReadDeadline(t time.Time) error  { return nil }
+func (sniffConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,117 @@
+package realgun
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// ConnState is a state of an underlying HTTP/2 connection.
+type ConnState int
+
+const (
+	// ConnDialing is entered when the connection is being dialed.
+	ConnDialing ConnState = iota
+	// ConnTLSHandshake is entered when the TLS handshake starts.
+	ConnTLSHandshake
+	// ConnEstablished is entered once streams can be placed on the connection.
+	ConnEstablished
+	// ConnDraining is entered once no new streams are placed on the
+	// connection, e.g. after the server sent GOAWAY. Active streams go on.
+	ConnDraining
+	// ConnClosed is entered when the connection is closed.
+	ConnClosed
+	// ConnFailed is entered when the dial or the connection fails.
+	ConnFailed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case ConnDialing:
+		return "dialing"
+	case ConnTLSHandshake:
+		return "tls-handshake"
+	case ConnEstablished:
+		return "established"
+	case ConnDraining:
+		return "draining"
+	case ConnClosed:
+		return "closed"
+	case ConnFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// ConnEvent reports a state transition of an underlying connection.
+type ConnEvent struct {
+	// ID is unique per connection within the process.
+	ID    uint64
+	Addr  string
+	State ConnState
+	// Err is the reason of ConnFailed.
+	Err error
+}
+
+var lastConnID uint64
+
+// connState tracks the state of a connection and reports its transitions.
+type connState struct {
+	cli  *Client
+	id   uint64
+	addr string
+
+	mu    sync.Mutex
+	state ConnState
+	// readErr is the first read error, telling failures from closes
+	readErr error
+}
+
+func (cli *Client) newConnState(addr string) *connState {
+	s := &connState{cli: cli, id: atomic.AddUint64(&lastConnID, 1), addr: addr}
+	s.emit(ConnDialing, nil)
+	return s
+}
+
+// set enters state unless the connection is closed or failed already.
+func (s *connState) set(state ConnState, err error) {
+	s.mu.Lock()
+	if s.state >= ConnClosed || (s.state == state && state != ConnDialing) {
+		s.mu.Unlock()
+		return
+	}
+	s.state = state
+	s.mu.Unlock()
+	s.emit(state, err)
+}
+
+func (s *connState) emit(state ConnState, err error) {
+	if s.cli.onConnState != nil {
+		s.cli.onConnState(ConnEvent{ID: s.id, Addr: s.addr, State: state, Err: err})
+	}
+}
+
+func (s *connState) readFailed(err error) {
+	if errors.Is(err, net.ErrClosed) {
+		return
+	}
+	s.mu.Lock()
+	if s.readErr == nil {
+		s.readErr = err
+	}
+	s.mu.Unlock()
+}
+
+// closed enters ConnFailed if reading had failed before, ConnClosed otherwise.
+func (s *connState) closed() {
+	s.mu.Lock()
+	err := s.readErr
+	s.mu.Unlock()
+	if err != nil {
+		s.set(ConnFailed, err)
+	} else {
+		s.set(ConnClosed, nil)
+	}
+}
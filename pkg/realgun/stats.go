@@ -0,0 +1,105 @@
+package realgun
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// NumActiveStreams returns the number of streams dialed by cli and not closed yet.
+func (cli *Client) NumActiveStreams() int {
+	return int(atomic.LoadInt64(&cli.activeStreams))
+}
+
+// NumOpenConns returns the number of underlying HTTP/2 connections cli currently holds open.
+func (cli *Client) NumOpenConns() int {
+	return int(atomic.LoadInt64(&cli.openConns))
+}
+
+// ConnStreams returns the number of open streams on each underlying HTTP/2
+// connection cli currently pools.
+func (cli *Client) ConnStreams() []int {
+	return cli.pool.connStreams()
+}
+
+// resources counts live resources of all Clients, accessed atomically.
+var resources struct {
+	streams int64
+	conns   int64
+}
+
+// OpenResources returns the number of stream goroutines and underlying
+// connections alive across all Clients of the process. Tests can assert that
+// both drop back to zero once every conn and Client is closed.
+func OpenResources() (streams, conns int) {
+	return int(atomic.LoadInt64(&resources.streams)), int(atomic.LoadInt64(&resources.conns))
+}
+
+type dialTLSFunc func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error)
+
+// timedDialFunc is a dialTLSFunc recording the phases of the dial in timing
+// and reporting them to state.
+type timedDialFunc func(ctx context.Context, network, addr string, cfg *tls.Config, timing *DialTiming, state *connState) (net.Conn, error)
+
+// trackConns wraps dial so that connections it returns are counted in
+// openConns and carry their dial timing and state.
+func (cli *Client) trackConns(dial timedDialFunc) dialTLSFunc {
+	return func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+		if limit := cli.limits.MaxConns; limit > 0 && cli.NumOpenConns() >= limit {
+			return nil, ErrOverLimit
+		}
+		if cli.dialTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, cli.dialTimeout)
+			defer cancel()
+		}
+		var timing DialTiming
+		state := cli.newConnState(addr)
+		conn, err := dial(ctx, network, addr, cfg, &timing, state)
+		if err != nil {
+			state.set(ConnFailed, err)
+			return nil, err
+		}
+		atomic.AddInt64(&cli.openConns, 1)
+		atomic.AddInt64(&resources.conns, 1)
+		state.set(ConnEstablished, nil)
+		return &trackedConn{lastRead: time.Now().UnixNano(), Conn: conn, cli: cli, timing: timing, state: state}, nil
+	}
+}
+
+type trackedConn struct {
+	// lastRead is the UnixNano time of the last read, accessed atomically
+	lastRead int64
+	net.Conn
+	cli    *Client
+	timing DialTiming
+	state  *connState
+	once   sync.Once
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.StoreInt64(&c.lastRead, time.Now().UnixNano())
+	if err != nil {
+		c.state.readFailed(err)
+	}
+	return n, err
+}
+
+// idle returns how long nothing was read from the connection.
+func (c *trackedConn) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastRead)))
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		atomic.AddInt64(&c.cli.openConns, -1)
+		atomic.AddInt64(&resources.conns, -1)
+	})
+	err := c.Conn.Close()
+	c.state.closed()
+	return err
+}
@@ -0,0 +1,47 @@
+package realgun
+
+import (
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// StreamLog describes an accepted stream once it ended, see
+// ServerConfig.OnStreamEnd.
+type StreamLog struct {
+	ID         uint64
+	RemoteAddr net.Addr
+	// ServerName is the SNI the client sent, empty over cleartext.
+	ServerName string
+	Path       string
+	// User is the user the stream was authenticated as, see GunConn.User.
+	User         string
+	Duration     time.Duration
+	BytesRead    int64
+	BytesWritten int64
+	// CloseReason tells why the stream ended, nil if it was closed without
+	// a reason.
+	CloseReason *CloseReason
+}
+
+// StreamLogFunc receives the log of every accepted stream.
+type StreamLogFunc func(log StreamLog)
+
+// streamLog returns the log of the stream of r once it ended.
+func (g *GunConn) streamLog(r *http.Request) StreamLog {
+	log := StreamLog{
+		ID:           g.id,
+		RemoteAddr:   g.remote,
+		Path:         r.URL.Path,
+		User:         g.User(),
+		Duration:     time.Since(g.created),
+		BytesRead:    atomic.LoadInt64(&g.bytesRead),
+		BytesWritten: atomic.LoadInt64(&g.bytesWritten),
+		CloseReason:  g.CloseReason(),
+	}
+	if r.TLS != nil {
+		log.ServerName = r.TLS.ServerName
+	}
+	return log
+}
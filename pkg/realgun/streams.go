@@ -0,0 +1,78 @@
+package realgun
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// StreamInfo describes an active stream of a Client.
+type StreamInfo struct {
+	ID           uint64
+	Age          time.Duration
+	BytesRead    int64
+	BytesWritten int64
+	Tag          string
+}
+
+// Streams returns the active streams of cli, ordered by ID.
+func (cli *Client) Streams() []StreamInfo {
+	cli.streamsMu.Lock()
+	conns := make([]*GunConn, 0, len(cli.streams))
+	for _, g := range cli.streams {
+		conns = append(conns, g)
+	}
+	cli.streamsMu.Unlock()
+	// Info takes the conn lock, which Close holds while removing the stream.
+	infos := make([]StreamInfo, 0, len(conns))
+	for _, g := range conns {
+		infos = append(infos, g.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// CloseStream closes the active stream with the given ID. It reports whether
+// such a stream existed.
+func (cli *Client) CloseStream(id uint64) bool {
+	cli.streamsMu.Lock()
+	g, ok := cli.streams[id]
+	cli.streamsMu.Unlock()
+	if ok {
+		_ = g.Close()
+	}
+	return ok
+}
+
+func (cli *Client) addStream(g *GunConn) {
+	cli.streamsMu.Lock()
+	cli.streams[g.id] = g
+	cli.streamsMu.Unlock()
+}
+
+func (cli *Client) removeStream(g *GunConn) {
+	cli.streamsMu.Lock()
+	delete(cli.streams, g.id)
+	cli.streamsMu.Unlock()
+}
+
+// Info returns a snapshot of the stream's statistics.
+func (g *GunConn) Info() StreamInfo {
+	g.mu.Lock()
+	tag := g.tag
+	g.mu.Unlock()
+	return StreamInfo{
+		ID:           g.id,
+		Age:          time.Since(g.created),
+		BytesRead:    atomic.LoadInt64(&g.bytesRead),
+		BytesWritten: atomic.LoadInt64(&g.bytesWritten),
+		Tag:          tag,
+	}
+}
+
+// SetTag attaches a free-form label to the stream, reported by Streams.
+func (g *GunConn) SetTag(tag string) {
+	g.mu.Lock()
+	g.tag = tag
+	g.mu.Unlock()
+}
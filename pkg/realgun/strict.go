@@ -0,0 +1,56 @@
+package realgun
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Strictness selects how closely a server checks that requests are gRPC
+// calls, trading interoperability against resistance to probing.
+type Strictness int
+
+const (
+	// StrictnessDefault requires POST and an application/grpc content type.
+	StrictnessDefault Strictness = iota
+	// StrictnessLenient accepts any method and content type on the stream
+	// paths, for clients and proxies mangling them.
+	StrictnessLenient
+	// StrictnessStrict also requires te: trailers and a content type gRPC
+	// servers accept, and ends streams sending compressed messages, which
+	// gun clients never do, as a gRPC server without compression would.
+	StrictnessStrict
+)
+
+var errCompressedMessage = errors.New("realgun: compressed message without a message encoding")
+
+// grpcInternal is the gRPC status code of a stream ended by a protocol
+// violation.
+const grpcInternal = 13
+
+// acceptedContentType reports whether contentType passes s.
+func (s Strictness) acceptedContentType(contentType string) bool {
+	switch s {
+	case StrictnessLenient:
+		return true
+	case StrictnessStrict:
+		// application/grpc, optionally followed by +subtype or ;parameters
+		rest := strings.TrimPrefix(contentType, "application/grpc")
+		return rest != contentType && (rest == "" || rest[0] == '+' || rest[0] == ';')
+	}
+	return strings.HasPrefix(contentType, "application/grpc")
+}
+
+// refuse returns the HTTP status refusing r under s, or 0 if r passes.
+func (s Strictness) refuse(r *http.Request) int {
+	if r.Method != http.MethodPost && s != StrictnessLenient {
+		return http.StatusNotFound
+	}
+	if !s.acceptedContentType(r.Header.Get("content-type")) {
+		return http.StatusUnsupportedMediaType
+	}
+	if s == StrictnessStrict && r.Header.Get("te") != "trailers" {
+		return http.StatusBadRequest
+	}
+	return 0
+}
@@ -0,0 +1,124 @@
+package realgun
+
+import (
+	"context"
+	"net"
+	"net/http/httptrace"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DialTiming breaks down where the time to set up a stream went.
+type DialTiming struct {
+	// Reused reports whether the stream was placed on an already open
+	// connection, in which case the dial phases are zero.
+	Reused       bool
+	DNS          time.Duration
+	Connect      time.Duration
+	TLSHandshake time.Duration
+	// ResponseHeader is the time from sending the request headers until the
+	// response headers arrived.
+	ResponseHeader time.Duration
+}
+
+// DialContextFunc dials the raw connections to the server.
+type DialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// remoteDialer dials the raw connections to the server.
+type remoteDialer struct {
+	// dialContext, if set, dials instead of net.Dialer
+	dialContext DialContextFunc
+	// resolver, if set, resolves addresses instead of net.DefaultResolver
+	resolver *net.Resolver
+	// ips, if set, are dialed instead of resolving ips.addr
+	ips *ipSet
+}
+
+// dialTimed connects to addr, recording the phases in timing. Without
+// dialContext it dials with net.Dialer, which keeps its fallback between
+// address families, and takes the DNS time as the time until the first
+// connect attempt. With ips for addr it connects to those instead of
+// resolving addr.
+func (d *remoteDialer) dialTimed(ctx context.Context, network, addr string, timing *DialTiming) (net.Conn, error) {
+	dialContext, ips := d.dialContext, d.ips
+	if ips != nil && ips.addr == addr {
+		if dialContext == nil {
+			var dialer net.Dialer
+			dialContext = dialer.DialContext
+		}
+		start := time.Now()
+		conn, err := ips.dial(ctx, func(addr string) (net.Conn, error) {
+			return dialContext(ctx, network, addr)
+		}, addr)
+		if err != nil {
+			return nil, err
+		}
+		timing.Connect = time.Since(start)
+		return conn, nil
+	}
+	if dialContext != nil {
+		start := time.Now()
+		conn, err := dialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		timing.Connect = time.Since(start)
+		return conn, nil
+	}
+	start := time.Now()
+	var resolved sync.Once
+	connectStart := start
+	dialer := &net.Dialer{
+		Resolver: d.resolver,
+		// called for every connect attempt, all after resolving addr
+		Control: func(string, string, syscall.RawConn) error {
+			resolved.Do(func() { connectStart = time.Now() })
+			return nil
+		},
+	}
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	resolved.Do(func() {})
+	timing.DNS = connectStart.Sub(start)
+	timing.Connect = time.Since(connectStart)
+	return conn, nil
+}
+
+// timingTrace returns the trace collecting g's timing during the request.
+func (g *GunConn) timingTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			if tc, ok := info.Conn.(*trackedConn); ok && !info.Reused {
+				g.timing = tc.timing
+			}
+			g.timing.Reused = info.Reused
+		},
+		WroteHeaders: func() {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			g.headerSent = time.Now()
+		},
+	}
+}
+
+// finishTiming is called by the stream goroutine once the response headers arrived.
+func (g *GunConn) finishTiming() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.headerSent.IsZero() {
+		g.timing.ResponseHeader = time.Since(g.headerSent)
+	}
+}
+
+// Timing returns the phase timings of the stream setup. They are complete
+// once the response headers arrived.
+func (g *GunConn) Timing() DialTiming {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.timing
+}
@@ -0,0 +1,117 @@
+package realgun
+
+var closedChan = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
+// pendingWrite is a write holding the write slot of a GunConn, either
+// running in the background for TryWrite or writeTimed, or a plain Write.
+type pendingWrite struct {
+	done chan struct{}
+	// err is the result, set before done is closed
+	err error
+}
+
+// TryWrite writes b without blocking. The hunk is handed off to a background
+// write and len(b) is returned at once; if another write is still in flight,
+// e.g. a previous TryWrite blocked on HTTP/2 flow control, TryWrite returns
+// ErrWouldBlock instead. An error of the background write is returned by the
+// next write.
+func (g *GunConn) TryWrite(b []byte) (int, error) {
+	p, err := g.claimWrite(wouldBlock)
+	if err != nil {
+		return 0, err
+	}
+	g.startWrite(p, b)
+	return len(b), nil
+}
+
+func wouldBlock(<-chan struct{}) error {
+	return ErrWouldBlock
+}
+
+// claimWrite takes the write slot, so writes go out in order. While another
+// write holds it, claimWrite waits with wait, or until it is done if wait is
+// nil. It returns the error of a finished background write instead, once.
+func (g *GunConn) claimWrite(wait func(<-chan struct{}) error) (*pendingWrite, error) {
+	for {
+		g.wmu.Lock()
+		p := g.pending
+		if p == nil {
+			p = &pendingWrite{done: make(chan struct{})}
+			g.pending = p
+			g.wmu.Unlock()
+			return p, nil
+		}
+		select {
+		case <-p.done:
+			g.pending = nil
+			g.wmu.Unlock()
+			if p.err != nil {
+				return nil, p.err
+			}
+			continue
+		default:
+		}
+		g.wmu.Unlock()
+		if wait == nil {
+			<-p.done
+		} else if err := wait(p.done); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// releaseWrite frees the write slot taken by p once its write is done.
+func (g *GunConn) releaseWrite(p *pendingWrite) {
+	g.wmu.Lock()
+	if g.pending == p {
+		g.pending = nil
+	}
+	g.wmu.Unlock()
+	close(p.done)
+}
+
+// startWrite writes a copy of b in the background, holding the slot p until
+// the next write collects the result.
+func (g *GunConn) startWrite(p *pendingWrite, b []byte) {
+	buf := append([]byte(nil), b...)
+	go func() {
+		_, p.err = g.write(buf)
+		close(p.done)
+	}()
+}
+
+// collectWrite frees the slot of the finished background write p and returns its error.
+func (g *GunConn) collectWrite(p *pendingWrite) error {
+	g.wmu.Lock()
+	if g.pending == p {
+		g.pending = nil
+	}
+	g.wmu.Unlock()
+	return p.err
+}
+
+// Writable returns a channel that is closed once the stream can take another
+// TryWrite without ErrWouldBlock.
+func (g *GunConn) Writable() <-chan struct{} {
+	g.wmu.Lock()
+	defer g.wmu.Unlock()
+	if g.pending == nil {
+		return closedChan
+	}
+	return g.pending.done
+}
+
+// waitPending blocks until no write is in flight, returning the error of a
+// finished background write.
+func (g *GunConn) waitPending() error {
+	p, err := g.claimWrite(nil)
+	if err != nil {
+		return err
+	}
+	g.releaseWrite(p)
+	return nil
+}